@@ -0,0 +1,421 @@
+// Copyright 2013 Bobby Powers. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package sim
+
+import (
+	"fmt"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/bpowers/go-xmile/smile"
+	"github.com/bpowers/go-xmile/xmile"
+)
+
+// dimension is a named list of subscripts that variables can be
+// arrayed over.
+type dimension struct {
+	name     string   // canonical name
+	elements []string // canonical element names
+}
+
+func newDimension(xd *xmile.Dimension) (*dimension, error) {
+	names, err := xd.ElementNames()
+	if err != nil {
+		return nil, err
+	}
+	d := &dimension{name: CanonicalName(xd.Name), elements: make([]string, len(names))}
+	for i, n := range names {
+		d.elements[i] = CanonicalName(n)
+	}
+	return d, nil
+}
+
+// index returns the position of the named element of d.  Elements can
+// also be given by their position, counting from 1.
+func (d *dimension) index(name string) (int, bool) {
+	name = CanonicalName(name)
+	for i, e := range d.elements {
+		if e == name {
+			return i, true
+		}
+	}
+	if n, err := strconv.Atoi(name); err == nil && n >= 1 && n <= len(d.elements) {
+		return n - 1, true
+	}
+	return 0, false
+}
+
+// array is an arrayed variable, which is simulated as a separate
+// scalar variable for each of its elements, named like
+// "pop[north,young]".
+type array struct {
+	name  string // canonical name
+	dims  []*dimension
+	elems []*variable // row-major: the last dimension varies fastest
+}
+
+// offset returns the position in a.elems of the element at the given
+// index in each dimension.
+func (a *array) offset(index []int) int {
+	off := 0
+	for i, d := range a.dims {
+		off = off*len(d.elements) + index[i]
+	}
+	return off
+}
+
+// declareArray creates a variable for each element of the arrayed
+// variable xv.
+func (s *Sim) declareArray(xv *xmile.Variable) ([]*variable, error) {
+	a := &array{name: CanonicalName(xv.Name)}
+	if _, ok := s.byName[a.name]; ok {
+		return nil, fmt.Errorf("%s: duplicate variable name", xv.Name)
+	} else if _, ok := s.arrays[a.name]; ok {
+		return nil, fmt.Errorf("%s: duplicate variable name", xv.Name)
+	}
+	n := 1
+	for _, xd := range xv.Dimensions {
+		d, ok := s.dims[CanonicalName(xd.Name)]
+		if !ok {
+			return nil, fmt.Errorf("%s: unknown dimension '%s'", xv.Name, xd.Name)
+		}
+		a.dims = append(a.dims, d)
+		n *= len(d.elements)
+	}
+
+	eqns := make([]string, n)
+	for i := range eqns {
+		eqns[i] = xv.Eqn
+	}
+	for _, xe := range xv.Elements {
+		subs := strings.Split(xe.Subscript, ",")
+		if len(subs) != len(a.dims) {
+			return nil, fmt.Errorf("%s: bad subscript '%s'", xv.Name, xe.Subscript)
+		}
+		index := make([]int, len(subs))
+		for i, sub := range subs {
+			var ok bool
+			if index[i], ok = a.dims[i].index(strings.TrimSpace(sub)); !ok {
+				return nil, fmt.Errorf("%s: bad subscript '%s'", xv.Name, xe.Subscript)
+			}
+		}
+		eqns[a.offset(index)] = xe.Eqn
+	}
+
+	a.elems = make([]*variable, n)
+	for off := range a.elems {
+		index := make([]int, len(a.dims))
+		names := make([]string, len(a.dims))
+		rest := off
+		for i := len(a.dims) - 1; i >= 0; i-- {
+			d := a.dims[i]
+			index[i] = rest % len(d.elements)
+			names[i] = d.elements[index[i]]
+			rest /= len(d.elements)
+		}
+		xe := *xv
+		xe.Name = a.name + "[" + strings.Join(names, ",") + "]"
+		xe.Eqn = eqns[off]
+		xe.Dimensions, xe.Elements = nil, nil
+		v, err := s.declare(&xe)
+		if err != nil {
+			return nil, err
+		}
+		v.array, v.index = a, index
+		a.elems[off] = v
+	}
+	s.arrays[a.name] = a
+	return a.elems, nil
+}
+
+// sameElement returns the element of a with the same subscripts as v,
+// an element of another array, for apply-to-all equations.  Every
+// dimension of a must be one of v's.
+func (s *Sim) sameElement(v *variable, a *array) (*variable, error) {
+	index := make([]int, len(a.dims))
+	for i, d := range a.dims {
+		j := v.dimIndex(d)
+		if j < 0 {
+			return nil, fmt.Errorf("'%s' needs a subscript for dimension '%s'", a.name, d.name)
+		}
+		index[i] = v.index[j]
+	}
+	return a.elems[a.offset(index)], nil
+}
+
+// dimIndex returns the position of d in the dimensions of v's array,
+// or -1 if v isn't arrayed over d.
+func (v *variable) dimIndex(d *dimension) int {
+	if v.array == nil {
+		return -1
+	}
+	for j, vd := range v.array.dims {
+		if vd == d {
+			return j
+		}
+	}
+	return -1
+}
+
+// element compiles a subscripted reference to an element of an
+// array.  Subscripts can be element names, numbers, dimension names
+// standing for the current element of the variable being compiled,
+// or expressions evaluated while running.
+func (c *compiler) element(n *smile.IndexExpr) (expr, error) {
+	id, ok := n.X.(*smile.Ident)
+	if !ok {
+		return nil, fmt.Errorf("only variables can be subscripted")
+	}
+	a, ok := c.s.arrays[CanonicalName(id.Name)]
+	if !ok {
+		return nil, fmt.Errorf("'%s' isn't an array", id.Name)
+	} else if len(n.Indices) != len(a.dims) {
+		return nil, fmt.Errorf("'%s' has %d dimension%s, not %d",
+			id.Name, len(a.dims), plural(len(a.dims)), len(n.Indices))
+	}
+
+	index, dynamic := make([]int, len(a.dims)), make([]expr, len(a.dims))
+	for i, x := range n.Indices {
+		var err error
+		if index[i], dynamic[i], err = c.subscript(a.dims[i], x); err != nil {
+			return nil, err
+		}
+	}
+	return c.elementAt(a, index, dynamic), nil
+}
+
+// dimPosition returns the position of the current element of the
+// variable being compiled in the dimension named by n.
+func (c *compiler) dimPosition(n *smile.Ident) (float64, bool) {
+	if _, ok := c.s.lookup(c.v.scope, n.Name); ok || c.v.scope != nil {
+		return 0, false
+	}
+	d, ok := c.s.dims[CanonicalName(n.Name)]
+	if !ok {
+		return 0, false
+	}
+	j := c.v.dimIndex(d)
+	if j < 0 {
+		return 0, false
+	}
+	return float64(c.v.index[j] + 1), true
+}
+
+// elementAt returns a reference to the element of a at index, or to
+// the element picked while running if any of the dynamic subscripts
+// aren't nil.  A fixed subscript of -1 is out of range, giving NaN.
+func (c *compiler) elementAt(a *array, index []int, dynamic []expr) expr {
+	for i, dyn := range dynamic {
+		if dyn == nil && index[i] < 0 {
+			return constant(math.NaN())
+		}
+	}
+	for _, dyn := range dynamic {
+		if dyn != nil {
+			// any element may be needed
+			for _, v := range a.elems {
+				c.ref(v)
+			}
+			return &elementAt{a, index, dynamic}
+		}
+	}
+	return c.ref(a.elems[a.offset(index)])
+}
+
+// elements compiles an array argument to a builtin, returning an
+// expression for each element it selects.  Wildcard subscripts, or
+// leaving out the subscripts entirely, select every element of a
+// dimension.  Anything other than an array is a single element.
+func (c *compiler) elements(x smile.Expr) ([]expr, error) {
+	var a *array
+	var subs []smile.Expr
+	switch n := x.(type) {
+	case *smile.Ident:
+		if _, ok := c.s.lookup(c.v.scope, n.Name); !ok && c.v.scope == nil {
+			a = c.s.arrays[CanonicalName(n.Name)]
+		}
+	case *smile.IndexExpr:
+		if id, ok := n.X.(*smile.Ident); ok {
+			a = c.s.arrays[CanonicalName(id.Name)]
+		}
+		subs = n.Indices
+	}
+	if a == nil {
+		e, err := c.compile(x)
+		if err != nil {
+			return nil, err
+		}
+		return []expr{e}, nil
+	}
+	if subs == nil {
+		subs = make([]smile.Expr, len(a.dims))
+		for i := range subs {
+			subs[i] = &smile.WildcardExpr{}
+		}
+	} else if len(subs) != len(a.dims) {
+		return nil, fmt.Errorf("'%s' has %d dimension%s, not %d",
+			a.name, len(a.dims), plural(len(a.dims)), len(subs))
+	}
+
+	index, dynamic := make([]int, len(a.dims)), make([]expr, len(a.dims))
+	var wild []int // the dimensions with wildcards
+	for i, x := range subs {
+		d := a.dims[i]
+		if w, ok := x.(*smile.WildcardExpr); ok {
+			if w.Dim != nil && CanonicalName(w.Dim.Name) != d.name {
+				return nil, fmt.Errorf("wildcard for dimension '%s' used as a subscript of '%s'",
+					w.Dim.Name, d.name)
+			}
+			wild = append(wild, i)
+			continue
+		}
+		var err error
+		if index[i], dynamic[i], err = c.subscript(d, x); err != nil {
+			return nil, err
+		}
+	}
+
+	// step through every combination of the wildcard dimensions,
+	// the last varying fastest.
+	var elems []expr
+	for {
+		elems = append(elems, c.elementAt(a, append([]int(nil), index...), dynamic))
+		i := len(wild) - 1
+		for ; i >= 0; i-- {
+			w := wild[i]
+			if index[w]++; index[w] < len(a.dims[w].elements) {
+				break
+			}
+			index[w] = 0
+		}
+		if i < 0 {
+			return elems, nil
+		}
+	}
+}
+
+// subscript compiles a subscript in dimension d, returning either a
+// fixed index or an expression for a 1-based index.
+func (c *compiler) subscript(d *dimension, x smile.Expr) (int, expr, error) {
+	switch x := x.(type) {
+	case *smile.Ident:
+		if i, ok := d.index(x.Name); ok {
+			return i, nil, nil
+		}
+		if xd, ok := c.s.dims[CanonicalName(x.Name)]; ok {
+			if xd != d {
+				return 0, nil, fmt.Errorf("dimension '%s' used as a subscript of '%s'", xd.name, d.name)
+			}
+			j := c.v.dimIndex(d)
+			if j < 0 {
+				return 0, nil, fmt.Errorf("'%s' isn't arrayed over '%s'", c.v.name, d.name)
+			}
+			return c.v.index[j], nil, nil
+		}
+	case *smile.WildcardExpr:
+		return 0, nil, fmt.Errorf("wildcard subscripts can only be passed to array builtins")
+	}
+	if f, ok := constValue(x); ok {
+		i := int(math.Floor(f)) - 1
+		if i < 0 || i >= len(d.elements) {
+			return 0, nil, fmt.Errorf("subscript %g is out of range for '%s'", f, d.name)
+		}
+		return i, nil, nil
+	}
+	// subscripts made from dimension names, like region - 1, are
+	// fixed for each element, so the element depends only on the
+	// element it refers to.  Out of range, they give -1.
+	if f, ok := foldConst(x, c.dimPosition); ok {
+		i := int(math.Floor(f)) - 1
+		if i < 0 || i >= len(d.elements) {
+			i = -1
+		}
+		return i, nil, nil
+	}
+	dyn, err := c.compile(x)
+	return 0, dyn, err
+}
+
+// elementAt is a reference to an element of an array with subscripts
+// only known while running.  Subscripts out of range give NaN.
+type elementAt struct {
+	a       *array
+	index   []int
+	dynamic []expr // nil for the subscripts in index
+}
+
+func (e *elementAt) eval(r *run) float64 {
+	off := 0
+	for i, d := range e.a.dims {
+		k := e.index[i]
+		if e.dynamic[i] != nil {
+			f := math.Floor(e.dynamic[i].eval(r)) - 1
+			if !(f >= 0 && f < float64(len(d.elements))) {
+				return math.NaN()
+			}
+			k = int(f)
+		}
+		off = off*len(d.elements) + k
+	}
+	return r.curr[e.a.elems[off].slot]
+}
+
+func sum(r *run, args []expr) float64 {
+	var total float64
+	for _, a := range args {
+		total += a.eval(r)
+	}
+	return total
+}
+
+func mean(r *run, args []expr) float64 {
+	return sum(r, args) / float64(len(args))
+}
+
+// stddev returns the population standard deviation of its arguments.
+func stddev(r *run, args []expr) float64 {
+	m := mean(r, args)
+	var squares float64
+	for _, a := range args {
+		d := a.eval(r) - m
+		squares += d * d
+	}
+	return math.Sqrt(squares / float64(len(args)))
+}
+
+// rank returns the position, counting from 1, of the element of an
+// array with the given rank, where the smallest element has rank 1.
+// Equal elements are ranked in order.  Ranks out of range give NaN.
+func rank(r *run, args []expr) float64 {
+	elems := args[:len(args)-1]
+	n := math.Floor(args[len(args)-1].eval(r))
+	if !(n >= 1 && n <= float64(len(elems))) {
+		return math.NaN()
+	}
+	values := make([]float64, len(elems))
+	order := make([]int, len(elems))
+	for i, e := range elems {
+		values[i] = e.eval(r)
+		order[i] = i
+	}
+	sort.SliceStable(order, func(i, j int) bool { return values[order[i]] < values[order[j]] })
+	return float64(order[int(n)-1] + 1)
+}
+
+func init() {
+	array := []ArgKind{ArrayArg}
+	for _, b := range []*Builtin{
+		{Name: "MEAN", MinArgs: 1, MaxArgs: -1, Kinds: array, eval: mean},
+		{Name: "RANK", MinArgs: 2, MaxArgs: 2, Kinds: []ArgKind{ArrayArg, ScalarArg}, eval: rank},
+		{Name: "SIZE", MinArgs: 1, MaxArgs: 1, Kinds: array,
+			eval: func(r *run, args []expr) float64 { return float64(len(args)) }},
+		{Name: "STDDEV", MinArgs: 1, MaxArgs: 1, Kinds: array, eval: stddev},
+		{Name: "SUM", MinArgs: 1, MaxArgs: 1, Kinds: array, eval: sum},
+	} {
+		register(b)
+	}
+}
@@ -0,0 +1,213 @@
+// Copyright 2013 Bobby Powers. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package sim_test
+
+import (
+	"math"
+	"strings"
+	"testing"
+
+	"github.com/bpowers/go-xmile/sim"
+	"github.com/bpowers/go-xmile/xmile"
+)
+
+// dim returns a dimension with the given elements, or of the given
+// size if there is only one element and it is a number.
+func dim(name string, elements ...string) *xmile.Dimension {
+	d := &xmile.Dimension{Name: name}
+	if len(elements) == 1 && strings.Trim(elements[0], "0123456789") == "" {
+		d.Size = elements[0]
+		return d
+	}
+	for _, e := range elements {
+		d.Elements = append(d.Elements, &xmile.Elem{Name: e})
+	}
+	return d
+}
+
+// arrayed makes v an array over the named dimensions.
+func arrayed(v *xmile.Variable, dims ...string) *xmile.Variable {
+	for _, d := range dims {
+		v.Dimensions = append(v.Dimensions, &xmile.Dimension{Name: d})
+	}
+	return v
+}
+
+// element gives the element of v with the given subscript its own
+// equation.
+func element(v *xmile.Variable, subscript, eqn string) *xmile.Variable {
+	v.Elements = append(v.Elements, &xmile.Element{Subscript: subscript, Eqn: eqn})
+	return v
+}
+
+func arrayFile(vars ...*xmile.Variable) *xmile.File {
+	f := newFile(0, 2, 1, vars...)
+	f.Dimensions = []*xmile.Dimension{dim("Region", "North", "South"), dim("age", "2")}
+	return f
+}
+
+func TestArrays(t *testing.T) {
+	res := run(t, arrayFile(
+		element(element(arrayed(aux("base", ""), "region"), "north", "10"), "South", "20"),
+		// dimension names stand for the element's position
+		arrayed(stock("pop", "base * age", []string{"births"}, nil), "region", "age"),
+		arrayed(flow("births", "pop * .1"), "region", "age"),
+	))
+	expectSeries(t, res, "pop[north,1]", []float64{10, 11, 12.1})
+	expectSeries(t, res, "pop[North, 2]", []float64{20, 22, 24.2})
+	expectSeries(t, res, "pop[south,1]", []float64{20, 22, 24.2})
+	expectSeries(t, res, "pop[south,2]", []float64{40, 44, 48.4})
+	expectSeries(t, res, "births[south,2]", []float64{4, 4.4, 4.84})
+	if _, ok := res.Lookup("pop"); ok {
+		t.Errorf("results for the whole array 'pop'")
+	}
+	if len(res.Values) != 10 {
+		t.Errorf("expected 10 series, not %d", len(res.Values))
+	}
+}
+
+func TestArraySubscripts(t *testing.T) {
+	res := run(t, arrayFile(
+		element(element(arrayed(aux("base", ""), "region"), "north", "10"), "south", "20"),
+		arrayed(aux("pop", "base * age"), "region", "age"),
+		aux("named", "pop[south, 2]"),
+		aux("numbered", "pop[1, 2]"),
+		// a dimension name as a subscript is the current element
+		arrayed(aux("young", "pop[region, 1]"), "region"),
+		aux("i", "1 + STEP(1, 1)"),
+		aux("dynamic", "base[i]"),
+		aux("out_of_range", "base[i + 1]"),
+		// subscripts made from dimension names are fixed for
+		// each element, so elements can refer to each other.
+		arrayed(aux("count", "IF region = 1 THEN 1 ELSE count[region - 1] + 1"), "region"),
+		arrayed(aux("previous", "base[region - 1]"), "region"),
+	))
+	expectSeries(t, res, "named", []float64{40, 40, 40})
+	expectSeries(t, res, "numbered", []float64{20, 20, 20})
+	expectSeries(t, res, "young[north]", []float64{10, 10, 10})
+	expectSeries(t, res, "young[south]", []float64{20, 20, 20})
+	expectSeries(t, res, "dynamic", []float64{10, 20, 20})
+	series, _ := res.Lookup("out_of_range")
+	if series[0] != 20 || !math.IsNaN(series[1]) {
+		t.Errorf("expected 20 then NaN, got %v", series)
+	}
+	expectSeries(t, res, "count[north]", []float64{1, 1, 1})
+	expectSeries(t, res, "count[south]", []float64{2, 2, 2})
+	expectSeries(t, res, "previous[south]", []float64{10, 10, 10})
+	if series, _ := res.Lookup("previous[north]"); !math.IsNaN(series[0]) {
+		t.Errorf("expected NaN before the first element, got %g", series[0])
+	}
+}
+
+func TestArraySmooth(t *testing.T) {
+	// stateful builtins in apply-to-all equations get a separate
+	// instance for each element.
+	res := run(t, arrayFile(
+		arrayed(aux("x", "10 * age"), "age"),
+		arrayed(aux("smooth", "SMTH1(x, 2, 0)"), "age"),
+	))
+	expectSeries(t, res, "smooth[1]", []float64{0, 5, 7.5})
+	expectSeries(t, res, "smooth[2]", []float64{0, 10, 15})
+}
+
+func TestArrayErrors(t *testing.T) {
+	base := func() *xmile.Variable { return arrayed(aux("base", "1"), "region") }
+	cases := []struct {
+		vars []*xmile.Variable
+		err  string
+	}{
+		{[]*xmile.Variable{arrayed(aux("x", "1"), "height")}, "unknown dimension 'height'"},
+		{[]*xmile.Variable{element(base(), "east", "1")}, "bad subscript 'east'"},
+		{[]*xmile.Variable{element(base(), "north, 1", "1")}, "bad subscript 'north, 1'"},
+		{[]*xmile.Variable{element(arrayed(aux("x", ""), "region"), "north", "1")}, "x[south]: missing equation"},
+		{[]*xmile.Variable{base(), aux("y", "base")}, "'base' needs a subscript for dimension 'region'"},
+		{[]*xmile.Variable{base(), aux("y", "base[1, 2]")}, "'base' has 1 dimension, not 2"},
+		{[]*xmile.Variable{base(), aux("y", "base[3]")}, "subscript 3 is out of range for 'region'"},
+		{[]*xmile.Variable{base(), aux("y", "base[age]")}, "dimension 'age' used as a subscript of 'region'"},
+		{[]*xmile.Variable{base(), aux("y", "base[region]")}, "'y' isn't arrayed over 'region'"},
+		{[]*xmile.Variable{base(), aux("y", "y[1]")}, "'y' isn't an array"},
+		{[]*xmile.Variable{base(), aux("base", "1")}, "duplicate variable name"},
+	}
+	for _, c := range cases {
+		_, err := sim.New(arrayFile(c.vars...))
+		if err == nil || !strings.Contains(err.Error(), c.err) {
+			t.Errorf("expected error containing '%s', got %v", c.err, err)
+		}
+	}
+}
+
+func TestArrayBuiltins(t *testing.T) {
+	res := run(t, arrayFile(
+		element(element(element(element(arrayed(aux("pop", ""), "region", "age"),
+			"north, 1", "3"), "north, 2", "1"), "south, 1", "4"), "south, 2", "8"),
+		aux("total", "SUM(pop[*, *])"),
+		aux("whole", "SUM(pop)"),
+		aux("young", "SUM(pop[*, 1])"),
+		arrayed(aux("average", "MEAN(pop[region, *])"), "region"),
+		aux("smallest", "MIN(pop[*, *])"),
+		aux("largest", "MAX(pop[*:region, 2])"),
+		aux("scalars", "MAX(pop[north, *], 2.5) + MEAN(1, 2, 6)"),
+		aux("spread", "STDDEV(pop[south, *])"),
+		aux("count", "SIZE(pop)"),
+		aux("second", "RANK(pop[*, *], 2)"),
+		aux("no_rank", "RANK(pop[*, *], 5)"),
+	))
+	expectSeries(t, res, "total", []float64{16, 16, 16})
+	expectSeries(t, res, "whole", []float64{16, 16, 16})
+	expectSeries(t, res, "young", []float64{7, 7, 7})
+	expectSeries(t, res, "average[north]", []float64{2, 2, 2})
+	expectSeries(t, res, "average[south]", []float64{6, 6, 6})
+	expectSeries(t, res, "smallest", []float64{1, 1, 1})
+	expectSeries(t, res, "largest", []float64{8, 8, 8})
+	expectSeries(t, res, "scalars", []float64{6, 6, 6})
+	expectSeries(t, res, "spread", []float64{2, 2, 2})
+	expectSeries(t, res, "count", []float64{4, 4, 4})
+	// the second smallest element is pop[north,1]
+	expectSeries(t, res, "second", []float64{1, 1, 1})
+	if series, _ := res.Lookup("no_rank"); !math.IsNaN(series[0]) {
+		t.Errorf("expected NaN for a rank out of range, got %g", series[0])
+	}
+}
+
+func TestArrayMinMax(t *testing.T) {
+	// with more than one argument, arrays without wildcards are
+	// the same element, as elsewhere.
+	res := run(t, arrayFile(
+		element(element(arrayed(aux("pop", ""), "region"), "north", "-3"), "south", "7"),
+		arrayed(aux("clamped", "MAX(pop, 0)"), "region"),
+		arrayed(aux("capped", "MIN(pop, 5)"), "region"),
+		arrayed(aux("average", "MEAN(pop, 1)"), "region"),
+		arrayed(aux("largest", "MAX(pop[*], 0)"), "region"),
+		arrayed(aux("smallest", "MIN(pop)"), "region"),
+	))
+	expectSeries(t, res, "clamped[north]", []float64{0, 0, 0})
+	expectSeries(t, res, "clamped[south]", []float64{7, 7, 7})
+	expectSeries(t, res, "capped[north]", []float64{-3, -3, -3})
+	expectSeries(t, res, "capped[south]", []float64{5, 5, 5})
+	expectSeries(t, res, "average[north]", []float64{-1, -1, -1})
+	expectSeries(t, res, "average[south]", []float64{4, 4, 4})
+	expectSeries(t, res, "largest[north]", []float64{7, 7, 7})
+	expectSeries(t, res, "smallest[south]", []float64{-3, -3, -3})
+}
+
+func TestArrayBuiltinErrors(t *testing.T) {
+	pop := func() *xmile.Variable { return arrayed(aux("pop", "1"), "region", "age") }
+	cases := []struct {
+		eqn string
+		err string
+	}{
+		{"SUM(pop[*])", "'pop' has 2 dimensions, not 1"},
+		{"SUM(pop[*:age, *])", "wildcard for dimension 'age' used as a subscript of 'region'"},
+		{"SUM(pop[*, 3])", "subscript 3 is out of range for 'age'"},
+		{"ABS(pop[*, 1])", "wildcard subscripts can only be passed to array builtins"},
+		{"SUM(pop[*, 1], 2)", "SUM takes 1 argument, not 2"},
+	}
+	for _, c := range cases {
+		_, err := sim.New(arrayFile(pop(), aux("x", c.eqn)))
+		if err == nil || !strings.Contains(err.Error(), c.err) {
+			t.Errorf("%s: expected error containing '%s', got %v", c.eqn, c.err, err)
+		}
+	}
+}
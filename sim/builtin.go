@@ -0,0 +1,321 @@
+// Copyright 2013 Bobby Powers. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package sim
+
+import (
+	"fmt"
+	"go/token"
+	"math"
+	"sort"
+	"strings"
+
+	"github.com/bpowers/go-xmile/smile"
+)
+
+// ArgKind describes what a builtin expects as one of its arguments.
+type ArgKind int
+
+const (
+	// ScalarArg is any expression with a single value.
+	ScalarArg ArgKind = iota
+	// ArrayArg is an array, like pop or pop[*, young], every
+	// element of which is passed to the builtin.  A scalar
+	// expression is passed as a single element.
+	ArrayArg
+)
+
+func (k ArgKind) String() string {
+	switch k {
+	case ScalarArg:
+		return "scalar"
+	case ArrayArg:
+		return "array"
+	default:
+		return "unknown"
+	}
+}
+
+// Builtin describes a function from the XMILE standard library.
+type Builtin struct {
+	Name    string // upper case
+	MinArgs int
+	MaxArgs int // -1 if there is no limit
+	// Kinds gives the kind of each argument.  If a call has more
+	// arguments than Kinds, the last kind applies to the rest.
+	Kinds []ArgKind
+
+	// eval calculates the result of a call from its compiled
+	// arguments, which it is responsible for evaluating.
+	eval func(r *run, args []expr) float64
+	// template, if not nil, returns the implicit variables a
+	// call to a stateful builtin is expanded into instead.
+	template func(args []smile.Expr) (*template, error)
+	// compile, if not nil, compiles calls to builtins that need
+	// more than the values of their arguments.
+	compile func(c *compiler, args []smile.Expr) (expr, error)
+}
+
+// Kind returns the kind of the builtin's i'th argument.
+func (b *Builtin) Kind(i int) ArgKind {
+	if len(b.Kinds) == 0 {
+		return ScalarArg
+	} else if i >= len(b.Kinds) {
+		return b.Kinds[len(b.Kinds)-1]
+	}
+	return b.Kinds[i]
+}
+
+// isArray reports whether the i'th of args is passed to the builtin
+// as an array.  Builtins like MAX that take any number of arguments
+// also take scalars, so when there is more than one argument only
+// those with wildcard subscripts are arrays, and an array named on
+// its own means the same element, as it does elsewhere.
+func (b *Builtin) isArray(args []smile.Expr, i int) bool {
+	if b.Kind(i) != ArrayArg {
+		return false
+	} else if b.MaxArgs >= 0 || len(args) == 1 {
+		return true
+	}
+	if ie, ok := args[i].(*smile.IndexExpr); ok {
+		for _, idx := range ie.Indices {
+			if _, ok := idx.(*smile.WildcardExpr); ok {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// checkArity returns an error if the builtin can't be called with n
+// arguments.
+func (b *Builtin) checkArity(n int) error {
+	switch {
+	case b.MinArgs == b.MaxArgs && n != b.MinArgs:
+		return fmt.Errorf("%s takes %d argument%s, not %d",
+			b.Name, b.MinArgs, plural(b.MinArgs), n)
+	case n < b.MinArgs:
+		return fmt.Errorf("%s takes at least %d argument%s, not %d",
+			b.Name, b.MinArgs, plural(b.MinArgs), n)
+	case b.MaxArgs >= 0 && n > b.MaxArgs:
+		return fmt.Errorf("%s takes at most %d argument%s, not %d",
+			b.Name, b.MaxArgs, plural(b.MaxArgs), n)
+	}
+	return nil
+}
+
+func plural(n int) string {
+	if n == 1 {
+		return ""
+	}
+	return "s"
+}
+
+var builtins = make(map[string]*Builtin)
+
+func register(b *Builtin) {
+	if _, ok := builtins[b.Name]; ok {
+		panic(fmt.Sprintf("builtin %s registered twice", b.Name))
+	}
+	builtins[b.Name] = b
+}
+
+// LookupBuiltin returns the builtin with the given name, which is
+// case-insensitive.
+func LookupBuiltin(name string) (*Builtin, bool) {
+	b, ok := builtins[strings.ToUpper(name)]
+	return b, ok
+}
+
+// Builtins returns every registered builtin, sorted by name.
+func Builtins() []*Builtin {
+	list := make([]*Builtin, 0, len(builtins))
+	for _, b := range builtins {
+		list = append(list, b)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Name < list[j].Name })
+	return list
+}
+
+// Check reports every call in x to a function that isn't a builtin,
+// or to a builtin with the wrong number of arguments, and every
+// wildcard subscript outside of an array argument to a builtin.
+// Errors are positioned at the offending call or subscript, and are
+// returned as a sorted smile.ErrorList.
+func Check(fset *token.FileSet, x smile.Expr) error {
+	return check(fset, x, LookupBuiltin)
+}
+
+// check is Check with the functions that can be called given by
+// lookup.
+func check(fset *token.FileSet, x smile.Expr, lookup func(string) (*Builtin, bool)) error {
+	var errs smile.ErrorVector
+	// arrays are the subscripted arguments that may have
+	// wildcards.
+	arrays := make(map[*smile.IndexExpr]bool)
+	smile.Inspect(x, func(n smile.Node) bool {
+		switch n := n.(type) {
+		case *smile.CallExpr:
+			pos := fset.Position(n.Pos())
+			b, ok := lookup(funName(n))
+			if !ok {
+				errs.Error(pos, fmt.Sprintf("unknown function '%s'", funName(n)))
+				break
+			} else if err := b.checkArity(len(n.Args)); err != nil {
+				errs.Error(pos, err.Error())
+			}
+			for i, a := range n.Args {
+				if ie, ok := a.(*smile.IndexExpr); ok && b.Kind(i) == ArrayArg {
+					arrays[ie] = true
+				}
+			}
+		case *smile.IndexExpr:
+			for _, idx := range n.Indices {
+				if w, ok := idx.(*smile.WildcardExpr); ok && !arrays[n] {
+					errs.Error(fset.Position(w.Pos()),
+						"wildcard subscripts can only be passed to array builtins")
+				}
+			}
+		}
+		return true
+	})
+	return errs.GetError(smile.Sorted)
+}
+
+func fn0(f func() float64) func(*run, []expr) float64 {
+	return func(r *run, args []expr) float64 {
+		return f()
+	}
+}
+
+func fn1(f func(float64) float64) func(*run, []expr) float64 {
+	return func(r *run, args []expr) float64 {
+		return f(args[0].eval(r))
+	}
+}
+
+// reduce evaluates every argument and folds them together with f.
+func reduce(f func(float64, float64) float64) func(*run, []expr) float64 {
+	return func(r *run, args []expr) float64 {
+		acc := args[0].eval(r)
+		for _, a := range args[1:] {
+			acc = f(acc, a.eval(r))
+		}
+		return acc
+	}
+}
+
+// safeDiv returns a/b, or the optional third argument (0 by default)
+// if b is zero.
+func safeDiv(r *run, args []expr) float64 {
+	a, b := args[0].eval(r), args[1].eval(r)
+	if b != 0 {
+		return a / b
+	}
+	if len(args) > 2 {
+		return args[2].eval(r)
+	}
+	return 0
+}
+
+// timeEpsilon is the fraction of DT within which two times are
+// treated as equal, so that rounding error in the simulation clock
+// doesn't move a STEP or PULSE to a neighbouring time step.
+const timeEpsilon = 1e-6
+
+// reached reports whether the current simulation time is at or after
+// t.
+func (r *run) reached(t float64) bool {
+	return r.time >= t-timeEpsilon*r.dt
+}
+
+// stepStart returns the time at the start of the current time step,
+// which the Runge-Kutta methods' evaluations part way through a step
+// share.
+func (r *run) stepStart() float64 {
+	return r.s.spec.Start + float64(r.step)*r.dt
+}
+
+// step returns 0 until the start time, and height afterwards.  It
+// changes at the start of a time step, whatever the integration
+// method.
+func step(r *run, args []expr) float64 {
+	height, start := args[0].eval(r), args[1].eval(r)
+	if r.stepStart() < start-timeEpsilon*r.dt {
+		return 0
+	}
+	return height
+}
+
+// ramp returns 0 until the start time, then increases by slope per
+// unit of time until the optional end time.
+func ramp(r *run, args []expr) float64 {
+	slope, start := args[0].eval(r), args[1].eval(r)
+	if !r.reached(start) {
+		return 0
+	}
+	t := r.time
+	if len(args) > 2 {
+		if end := args[2].eval(r); r.reached(end) {
+			t = end
+		}
+	}
+	return slope * (t - start)
+}
+
+// pulse returns magnitude/DT for the single time step starting at the
+// first time, so that a stock it flows into changes by magnitude.
+// If interval is positive the pulse repeats every interval
+// afterwards, otherwise there is only one.  Like STEP, pulses are
+// timed by the start of each time step.
+func pulse(r *run, args []expr) float64 {
+	magnitude, first := args[0].eval(r), args[1].eval(r)
+	var interval float64
+	if len(args) > 2 {
+		interval = args[2].eval(r)
+	}
+	now, eps := r.stepStart(), timeEpsilon*r.dt
+	if now < first-eps {
+		return 0
+	}
+	next := first
+	if interval > 0 {
+		next += math.Floor((now-first+eps)/interval) * interval
+	}
+	if now < next+r.dt-eps {
+		return magnitude / r.dt
+	}
+	return 0
+}
+
+func init() {
+	for _, b := range []*Builtin{
+		{Name: "ABS", MinArgs: 1, MaxArgs: 1, eval: fn1(math.Abs)},
+		{Name: "ARCCOS", MinArgs: 1, MaxArgs: 1, eval: fn1(math.Acos)},
+		{Name: "ARCSIN", MinArgs: 1, MaxArgs: 1, eval: fn1(math.Asin)},
+		{Name: "ARCTAN", MinArgs: 1, MaxArgs: 1, eval: fn1(math.Atan)},
+		{Name: "COS", MinArgs: 1, MaxArgs: 1, eval: fn1(math.Cos)},
+		{Name: "DT", eval: func(r *run, args []expr) float64 { return r.dt }},
+		{Name: "EXP", MinArgs: 1, MaxArgs: 1, eval: fn1(math.Exp)},
+		{Name: "INF", eval: fn0(func() float64 { return math.Inf(1) })},
+		{Name: "INT", MinArgs: 1, MaxArgs: 1, eval: fn1(math.Floor)},
+		{Name: "LN", MinArgs: 1, MaxArgs: 1, eval: fn1(math.Log)},
+		{Name: "LOG10", MinArgs: 1, MaxArgs: 1, eval: fn1(math.Log10)},
+		{Name: "MAX", MinArgs: 1, MaxArgs: -1, Kinds: []ArgKind{ArrayArg}, eval: reduce(math.Max)},
+		{Name: "MIN", MinArgs: 1, MaxArgs: -1, Kinds: []ArgKind{ArrayArg}, eval: reduce(math.Min)},
+		{Name: "PI", eval: fn0(func() float64 { return math.Pi })},
+		{Name: "PULSE", MinArgs: 2, MaxArgs: 3, eval: pulse},
+		{Name: "RAMP", MinArgs: 2, MaxArgs: 3, eval: ramp},
+		{Name: "SAFEDIV", MinArgs: 2, MaxArgs: 3, eval: safeDiv},
+		{Name: "SIN", MinArgs: 1, MaxArgs: 1, eval: fn1(math.Sin)},
+		{Name: "SQRT", MinArgs: 1, MaxArgs: 1, eval: fn1(math.Sqrt)},
+		{Name: "STARTTIME", eval: func(r *run, args []expr) float64 { return r.s.spec.Start }},
+		{Name: "STEP", MinArgs: 2, MaxArgs: 2, eval: step},
+		{Name: "STOPTIME", eval: func(r *run, args []expr) float64 { return r.s.spec.Stop }},
+		{Name: "TAN", MinArgs: 1, MaxArgs: 1, eval: fn1(math.Tan)},
+		{Name: "TIME", eval: func(r *run, args []expr) float64 { return r.time }},
+	} {
+		register(b)
+	}
+}
@@ -0,0 +1,198 @@
+// Copyright 2013 Bobby Powers. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package sim_test
+
+import (
+	"go/token"
+	"math"
+	"testing"
+
+	"github.com/bpowers/go-xmile/sim"
+	"github.com/bpowers/go-xmile/smile"
+)
+
+func TestBuiltins(t *testing.T) {
+	cases := []struct {
+		eqn      string
+		expected float64
+	}{
+		{"ABS(-3)", 3},
+		{"abs(2)", 2},
+		{"EXP(0)", 1},
+		{"LN(EXP(2))", 2},
+		{"LOG10(1000)", 3},
+		{"SQRT(16)", 4},
+		{"INT(2.7)", 2},
+		{"INT(-2.5)", -3},
+		{"MIN(3, 1, 2)", 1},
+		{"MAX(3, 1, 2)", 3},
+		{"MAX(x)", 5},
+		{"SIN(0) + COS(0)", 1},
+		{"TAN(0)", 0},
+		{"ARCSIN(1) * 2", math.Pi},
+		{"ARCCOS(1)", 0},
+		{"ARCTAN(1) * 4", math.Pi},
+		{"PI", math.Pi},
+		{"PI()", math.Pi},
+		{"SAFEDIV(x, 2)", 2.5},
+		{"SAFEDIV(x, 0)", 0},
+		{"SAFEDIV(x, 0, -1)", -1},
+	}
+	for _, c := range cases {
+		res := run(t, newFile(0, 0, 1, aux("x", "5"), aux("y", c.eqn)))
+		if y := final(t, res, "y"); math.Abs(y-c.expected) > 1e-12 {
+			t.Errorf("%s: expected %g, got %g", c.eqn, c.expected, y)
+		}
+	}
+}
+
+func TestTimeBuiltins(t *testing.T) {
+	f := newFile(1, 2, .5,
+		aux("t", "TIME"),
+		aux("dt2", "DT * 2"),
+		aux("span", "STOPTIME - STARTTIME"),
+	)
+	res := run(t, f)
+	expectSeries(t, res, "t", []float64{1, 1.5, 2})
+	expectSeries(t, res, "dt2", []float64{1, 1, 1})
+	expectSeries(t, res, "span", []float64{1, 1, 1})
+}
+
+func TestStep(t *testing.T) {
+	res := run(t, newFile(0, 1, .25, aux("s", "STEP(2, .5)"), aux("early", "STEP(3, .375)")))
+	expectSeries(t, res, "s", []float64{0, 0, 2, 2, 2})
+	// a start time between time steps takes effect at the next one
+	expectSeries(t, res, "early", []float64{0, 0, 3, 3, 3})
+
+	// .1 can't be represented exactly, so 3*.1 != .3
+	res = run(t, newFile(0, .5, .1, aux("s", "STEP(1, .3)")))
+	expectSeries(t, res, "s", []float64{0, 0, 0, 1, 1, 1})
+
+	// the Runge-Kutta methods don't see the step early part way
+	// through the time step before it.
+	for _, method := range []string{"Euler", "RK2", "RK4"} {
+		f := newFile(0, 3, 1,
+			stock("total", "0", []string{"in"}, nil),
+			flow("in", "STEP(2, 1)"),
+		)
+		f.SimSpec.Method = method
+		expectSeries(t, run(t, f), "total", []float64{0, 0, 2, 4})
+	}
+}
+
+func TestRamp(t *testing.T) {
+	res := run(t, newFile(0, 1.5, .25,
+		aux("r", "RAMP(2, .5)"),
+		aux("capped", "RAMP(2, .5, 1)"),
+	))
+	expectSeries(t, res, "r", []float64{0, 0, 0, .5, 1, 1.5, 2})
+	expectSeries(t, res, "capped", []float64{0, 0, 0, .5, 1, 1, 1})
+}
+
+func TestPulse(t *testing.T) {
+	res := run(t, newFile(0, 2, .25,
+		aux("once", "PULSE(1, .5)"),
+		aux("repeat", "PULSE(1, .5, .75)"),
+		stock("total", "0", []string{"in"}, nil),
+		flow("in", "PULSE(3, .5, .5)"),
+	))
+	expectSeries(t, res, "once", []float64{0, 0, 4, 0, 0, 0, 0, 0, 0})
+	expectSeries(t, res, "repeat", []float64{0, 0, 4, 0, 0, 4, 0, 0, 4})
+	// each pulse adds its magnitude to the stock
+	expectSeries(t, res, "total", []float64{0, 0, 0, 3, 3, 6, 6, 9, 9})
+
+	res = run(t, newFile(0, 1, .1, aux("p", "PULSE(.1, .3, .3)")))
+	expectSeries(t, res, "p", []float64{0, 0, 0, 1, 0, 0, 1, 0, 0, 1, 0})
+
+	for _, method := range []string{"Euler", "RK2", "RK4"} {
+		f := newFile(0, 4, 1,
+			stock("s", "0", []string{"in"}, nil),
+			flow("in", "PULSE(6, 1, 2)"),
+		)
+		f.SimSpec.Method = method
+		expectSeries(t, run(t, f), "s", []float64{0, 0, 6, 6, 12})
+	}
+}
+
+func TestBuiltinRegistry(t *testing.T) {
+	b, ok := sim.LookupBuiltin("max")
+	if !ok || b.Name != "MAX" || b.MinArgs != 1 || b.MaxArgs != -1 {
+		t.Fatalf("unexpected MAX builtin: %#v", b)
+	}
+	// MAX takes arrays, or any number of scalars
+	if b.Kind(5) != sim.ArrayArg {
+		t.Errorf("expected array arguments to MAX, got %s", b.Kind(5))
+	}
+	if b, _ = sim.LookupBuiltin("RANK"); b.Kind(0) != sim.ArrayArg || b.Kind(1) != sim.ScalarArg {
+		t.Errorf("expected RANK to take an array and a scalar, got %s and %s", b.Kind(0), b.Kind(1))
+	}
+	if _, ok := sim.LookupBuiltin("no_such_function"); ok {
+		t.Errorf("found a builtin that doesn't exist")
+	}
+	list := sim.Builtins()
+	for i := 1; i < len(list); i++ {
+		if list[i-1].Name >= list[i].Name {
+			t.Errorf("Builtins not sorted: %s before %s", list[i-1].Name, list[i].Name)
+		}
+	}
+}
+
+func TestCheck(t *testing.T) {
+	type checkErr struct {
+		col int
+		msg string
+	}
+	cases := []struct {
+		eqn  string
+		errs []checkErr
+	}{
+		{"a + MAX(b, 2)", nil},
+		{"a + foo(1)", []checkErr{{5, "unknown function 'foo'"}}},
+		{"ABS(1, 2)", []checkErr{{1, "ABS takes 1 argument, not 2"}}},
+		{"MIN()", []checkErr{{1, "MIN takes at least 1 argument, not 0"}}},
+		{"SAFEDIV(1, 2, 3, 4)", []checkErr{{1, "SAFEDIV takes at most 3 arguments, not 4"}}},
+		{"bar(ABS())", []checkErr{{1, "unknown function 'bar'"}, {5, "ABS takes 1 argument, not 0"}}},
+		{"SUM(pop[*, young]) + RANK(pop[north, *:age], 1)", nil},
+		{"pop[*]", []checkErr{{5, "wildcard subscripts can only be passed to array builtins"}}},
+		{"ABS(pop[*])", []checkErr{{9, "wildcard subscripts can only be passed to array builtins"}}},
+		{"SUM(pop[*] + 1)", []checkErr{{9, "wildcard subscripts can only be passed to array builtins"}}},
+	}
+	for _, c := range cases {
+		fset := token.NewFileSet()
+		x, err := smile.ParseExpr(fset, "test", c.eqn)
+		if err != nil {
+			t.Fatalf("ParseExpr(%s): %s", c.eqn, err)
+		}
+		err = sim.Check(fset, x)
+		if c.errs == nil {
+			if err != nil {
+				t.Errorf("Check(%s): unexpected error %s", c.eqn, err)
+			}
+			continue
+		}
+		list, ok := err.(smile.ErrorList)
+		if !ok || len(list) != len(c.errs) {
+			t.Errorf("Check(%s): expected %d errors, got %v", c.eqn, len(c.errs), err)
+			continue
+		}
+		for i, e := range list {
+			if e.Pos.Column != c.errs[i].col || e.Msg != c.errs[i].msg {
+				t.Errorf("Check(%s): expected '%d: %s', got '%d: %s'",
+					c.eqn, c.errs[i].col, c.errs[i].msg, e.Pos.Column, e.Msg)
+			}
+		}
+	}
+}
+
+func TestCheckOnCompile(t *testing.T) {
+	_, err := sim.New(newFile(0, 1, 1, aux("a", "1"), aux("b", "a +\n  frob(a)")))
+	list, ok := err.(smile.ErrorList)
+	if !ok || len(list) != 1 {
+		t.Fatalf("expected a single positioned error, got %v", err)
+	}
+	if pos := list[0].Pos; pos.Filename != "b" || pos.Line != 2 || pos.Column != 3 {
+		t.Errorf("expected error at b:2:3, got %s", list[0])
+	}
+}
@@ -0,0 +1,546 @@
+// Copyright 2013 Bobby Powers. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package sim
+
+import (
+	"fmt"
+	"go/token"
+	"math"
+	"strconv"
+	"strings"
+
+	"github.com/bpowers/go-xmile/smile"
+	"github.com/bpowers/go-xmile/xmile"
+)
+
+type varKind int
+
+const (
+	kindAux varKind = iota
+	kindFlow
+	kindStock
+)
+
+func (k varKind) String() string {
+	switch k {
+	case kindAux:
+		return "aux"
+	case kindFlow:
+		return "flow"
+	case kindStock:
+		return "stock"
+	default:
+		return "unknown"
+	}
+}
+
+// variable is the compiled form of a model entity.
+type variable struct {
+	name     string // canonical name
+	kind     varKind
+	slot     int // index into a run's values
+	ast      smile.Expr
+	eqn      expr
+	deps     []*variable  // variables referenced by eqn
+	table    *xmile.Table // graphical function applied to eqn, or nil
+	inflows  []*variable  // stocks only
+	outflows []*variable  // stocks only
+	uniflow  bool         // a flow clamped at zero
+	leak     bool         // a leakage flow out of a conveyor
+	overflow bool         // the overflow of a queue
+	// discrete stocks, like conveyors, are updated once per time
+	// step by their own rules rather than integrated.
+	discrete bool
+	// conveyor is set for conveyors and the flows out of them,
+	// and queue and oven likewise for queues and ovens.
+	conveyor *conveyor
+	queue    *queue
+	oven     *oven
+	// array is set for the elements of arrayed variables, with
+	// index giving the element's position in each dimension.
+	array *array
+	index []int
+
+	// initDeps are variables needed only to calculate the initial
+	// value of eqn, like the input of a DELAY without an initial
+	// value.
+	initDeps []*variable
+	// implicit variables are created by expanding calls to
+	// stateful builtins, and are not part of a run's Results.
+	implicit bool
+	// scope resolves the names in eqn, if it isn't the model's
+	// namespace, as for implicit variables and the variables of
+	// modules.
+	scope map[string]*variable
+	// alias, if set by a module connection, is the variable whose
+	// value replaces eqn.
+	alias *variable
+	// instances counts the implicit instances created for calls
+	// in eqn, to give each a unique name.
+	instances int
+	// expanding holds the macros whose expansion the variable is
+	// part of, to catch macros that call themselves.
+	expanding []*Builtin
+}
+
+// CanonicalName returns the form of a variable name used to key
+// Results.Values.
+func CanonicalName(name string) string {
+	return xmile.CanonicalName(name)
+}
+
+func (s *Sim) compile(m *xmile.Model) error {
+	// decls holds every variable in the model and its modules,
+	// including every element of arrayed variables.
+	var decls []decl
+	var modules []module
+	if err := s.declareModel(m, "", nil, nil, &decls, &modules); err != nil {
+		return err
+	}
+	for _, mod := range modules {
+		if err := s.connect(mod); err != nil {
+			return err
+		}
+	}
+
+	for _, d := range decls {
+		xv, v := d.xv, d.v
+		if v.kind == kindFlow {
+			v.uniflow = xv.NonNegative(s.behavior)
+			v.leak = xv.Leak != nil
+			v.overflow = xv.Overflow != nil
+			if xv.LeakInts != nil {
+				return fmt.Errorf("%s: integer leakage is not supported", xv.Name)
+			}
+		}
+		if v.kind != kindStock {
+			continue
+		}
+		if xv.NonNegative(s.behavior) && !v.discrete {
+			s.nonNegStocks = append(s.nonNegStocks, v)
+		}
+		var err error
+		if v.inflows, err = s.flowList(v, xv.Inflows); err != nil {
+			return err
+		}
+		if v.outflows, err = s.flowList(v, xv.Outflows); err != nil {
+			return err
+		}
+	}
+	for _, d := range decls {
+		var err error
+		switch xv := d.xv; {
+		case xv.Conveyor != nil:
+			err = s.compileConveyor(d.v, xv.Conveyor)
+		case xv.Queue != nil:
+			err = s.compileQueue(d.v)
+		case xv.Oven != nil:
+			err = s.compileOven(d.v, xv.Oven)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	for _, v := range s.vars {
+		if v.overflow && v.queue == nil {
+			return fmt.Errorf("%s: only flows out of a queue can overflow", v.name)
+		}
+	}
+
+	// compiling a variable may add implicit variables, which
+	// are compiled in turn.
+	for i := 0; i < len(s.vars); i++ {
+		if err := s.compileVar(s.vars[i]); err != nil {
+			return err
+		}
+	}
+
+	return s.sort()
+}
+
+// add gives v the next slot.  Implicit variables can't be referred
+// to by name from the model.
+func (s *Sim) add(v *variable) {
+	v.slot = len(s.vars)
+	s.vars = append(s.vars, v)
+	if v.kind == kindStock && !v.discrete {
+		s.stocks = append(s.stocks, v)
+	}
+	if !v.implicit {
+		s.byName[v.name] = v
+	}
+}
+
+// isConstant reports whether v's equation is a number or arithmetic
+// on numbers.
+func (v *variable) isConstant() bool {
+	if v.ast == nil || v.alias != nil || v.table != nil {
+		return false
+	}
+	_, ok := constValue(v.ast)
+	return ok
+}
+
+// lookup finds the variable named name in the given scope, or in the
+// model if scope is nil.
+func (s *Sim) lookup(scope map[string]*variable, name string) (*variable, bool) {
+	name = CanonicalName(name)
+	if scope != nil {
+		v, ok := scope[name]
+		return v, ok
+	}
+	v, ok := s.byName[name]
+	return v, ok
+}
+
+// declareAll creates the variables for xv: one for each element if
+// it is arrayed, and otherwise just one.
+func (s *Sim) declareAll(xv *xmile.Variable) ([]*variable, error) {
+	if len(xv.Dimensions) > 0 {
+		return s.declareArray(xv)
+	}
+	v, err := s.declare(xv)
+	if err != nil {
+		return nil, err
+	}
+	return []*variable{v}, nil
+}
+
+// declare creates a variable for xv, parsing but not yet compiling
+// its equation.
+func (s *Sim) declare(xv *xmile.Variable) (*variable, error) {
+	v := &variable{name: CanonicalName(xv.Name)}
+	switch xv.XMLName.Local {
+	case "aux":
+		v.kind = kindAux
+	case "flow":
+		v.kind = kindFlow
+	case "stock":
+		v.kind = kindStock
+	default:
+		return nil, fmt.Errorf("%s: unsupported variable type '%s'",
+			xv.Name, xv.XMLName.Local)
+	}
+	if v.name == "" {
+		return nil, fmt.Errorf("%s with an empty name", v.kind)
+	} else if _, ok := s.byName[v.name]; ok {
+		return nil, fmt.Errorf("%s: duplicate variable name", xv.Name)
+	} else if _, ok := s.arrays[v.name]; ok {
+		return nil, fmt.Errorf("%s: duplicate variable name", xv.Name)
+	}
+
+	for _, d := range []struct {
+		is   bool
+		name string
+	}{
+		{xv.Conveyor != nil, "conveyors"},
+		{xv.Queue != nil, "queues"},
+		{xv.Oven != nil, "ovens"},
+	} {
+		if !d.is {
+			continue
+		} else if v.kind != kindStock {
+			return nil, fmt.Errorf("%s: only stocks can be %s", xv.Name, d.name)
+		} else if v.discrete {
+			return nil, fmt.Errorf("%s: a stock can only be one of a conveyor, queue or oven", xv.Name)
+		}
+		v.discrete = true
+	}
+
+	var err error
+	if xv.GF != nil {
+		if v.kind == kindStock {
+			return nil, fmt.Errorf("%s: stocks can't have a gf", xv.Name)
+		}
+		if v.table, err = xv.GF.Table(); err != nil {
+			return nil, fmt.Errorf("%s: %s", xv.Name, err)
+		}
+	}
+
+	if strings.TrimSpace(xv.Eqn) == "" {
+		// the outflows of conveyors, queues and ovens, and
+		// the inputs of modules, need no equation.  Other
+		// variables are checked when they are compiled.
+		return v, nil
+	}
+	if v.ast, err = smile.ParseExpr(s.fset, v.name, xv.Eqn); err != nil {
+		return nil, fmt.Errorf("smile.Parse(%s, '%s'): %s", xv.Name, xv.Eqn, err)
+	}
+	if err = s.check(v.ast); err != nil {
+		return nil, err
+	}
+	return v, nil
+}
+
+// flowList resolves the names of a stock's inflows or outflows.  The
+// elements of an arrayed stock use the same element of arrayed
+// flows.
+func (s *Sim) flowList(stock *variable, names []string) ([]*variable, error) {
+	flows := make([]*variable, 0, len(names))
+	for _, n := range names {
+		f, ok := s.lookup(stock.scope, n)
+		if a, isArray := s.arrays[CanonicalName(n)]; !ok && isArray && stock.scope == nil {
+			var err error
+			if f, err = s.sameElement(stock, a); err != nil {
+				return nil, fmt.Errorf("%s: %s", stock.name, err)
+			}
+			ok = true
+		}
+		if !ok {
+			return nil, fmt.Errorf("%s: unknown flow '%s'", stock.name, n)
+		} else if f.kind != kindFlow {
+			return nil, fmt.Errorf("%s: '%s' is a %s, not a flow",
+				stock.name, n, f.kind)
+		}
+		flows = append(flows, f)
+	}
+	return flows, nil
+}
+
+func (s *Sim) compileVar(v *variable) (err error) {
+	c := &compiler{s: s, v: v, seen: make(map[*variable]bool)}
+	if v.alias != nil {
+		v.eqn = c.ref(v.alias)
+		return nil
+	} else if v.kind == kindFlow && v.conveyor != nil && !v.leak {
+		v.eqn = c.conveyorFlow(v, nil)
+		return nil
+	} else if v.kind == kindFlow && v.oven != nil {
+		// the oven decides when it empties
+		v.eqn = &ovenOutflow{v.oven}
+		return nil
+	} else if v.ast == nil && v.queue != nil {
+		// the outflow takes whatever it can from the queue
+		v.eqn = constant(math.Inf(1))
+		return nil
+	} else if v.ast == nil {
+		return fmt.Errorf("%s: missing equation", v.name)
+	}
+	if v.eqn, err = c.compile(v.ast); err != nil {
+		return fmt.Errorf("%s: %s", v.name, err)
+	}
+	if v.kind == kindFlow && v.conveyor != nil {
+		v.eqn = c.conveyorFlow(v, v.eqn)
+	}
+	if v.table != nil {
+		v.eqn = &lookup{v.table, v.eqn}
+	}
+	if v.uniflow {
+		v.eqn = &nonNegative{v.eqn}
+	}
+	return nil
+}
+
+// compiler turns the AST of a single variable's equation into an
+// expr, recording the variable's dependencies as it goes.
+type compiler struct {
+	s    *Sim
+	v    *variable
+	seen map[*variable]bool
+}
+
+func (c *compiler) compile(n smile.Expr) (expr, error) {
+	switch n := n.(type) {
+	case *smile.BasicLit:
+		f, err := strconv.ParseFloat(n.Value, 64)
+		if err != nil {
+			return nil, fmt.Errorf("bad number '%s'", n.Value)
+		}
+		return constant(f), nil
+	case *smile.Ident:
+		return c.ident(n)
+	case *smile.ParenExpr:
+		return c.compile(n.X)
+	case *smile.UnaryExpr:
+		x, err := c.compile(n.X)
+		if err != nil {
+			return nil, err
+		}
+		switch n.Op {
+		case token.ADD:
+			return x, nil
+		case token.SUB, token.NOT:
+			return &unary{n.Op, x}, nil
+		}
+		return nil, fmt.Errorf("unsupported unary operator %s", n.Op)
+	case *smile.BinaryExpr:
+		x, err := c.compile(n.X)
+		if err != nil {
+			return nil, err
+		}
+		y, err := c.compile(n.Y)
+		if err != nil {
+			return nil, err
+		}
+		switch n.Op {
+		case token.XOR, token.ADD, token.SUB, token.MUL, token.QUO, token.REM,
+			token.EQL, token.NEQ, token.LSS, token.LEQ, token.GTR, token.GEQ,
+			token.LAND, token.LOR:
+			return &binary{n.Op, x, y}, nil
+		}
+		return nil, fmt.Errorf("unsupported binary operator %s", n.Op)
+	case *smile.IfExpr:
+		cond, err := c.compile(n.Cond)
+		if err != nil {
+			return nil, err
+		}
+		t, err := c.compile(n.Then)
+		if err != nil {
+			return nil, err
+		}
+		f, err := c.compile(n.Else)
+		if err != nil {
+			return nil, err
+		}
+		return &ifExpr{cond, t, f}, nil
+	case *smile.IndexExpr:
+		return c.element(n)
+	case *smile.CallExpr:
+		b, ok := c.s.function(funName(n))
+		if !ok {
+			return nil, fmt.Errorf("unknown function '%s'", funName(n))
+		} else if err := b.checkArity(len(n.Args)); err != nil {
+			return nil, err
+		}
+		if b.template != nil {
+			return c.instantiate(b, n)
+		} else if b.compile != nil {
+			return b.compile(c, n.Args)
+		}
+		args := make([]expr, 0, len(n.Args))
+		for i, a := range n.Args {
+			if b.isArray(n.Args, i) {
+				elems, err := c.elements(a)
+				if err != nil {
+					return nil, err
+				}
+				args = append(args, elems...)
+				continue
+			}
+			arg, err := c.compile(a)
+			if err != nil {
+				return nil, err
+			}
+			args = append(args, arg)
+		}
+		return &call{b, args}, nil
+	}
+	return nil, fmt.Errorf("unsupported expression %T", n)
+}
+
+func (c *compiler) ident(n *smile.Ident) (expr, error) {
+	v, ok := c.s.lookup(c.v.scope, n.Name)
+	if !ok && c.v.scope == nil {
+		name := CanonicalName(n.Name)
+		if a, ok := c.s.arrays[name]; ok {
+			// in apply-to-all equations, arrays without
+			// subscripts refer to the same element.
+			v, err := c.s.sameElement(c.v, a)
+			if err != nil {
+				return nil, err
+			}
+			return c.ref(v), nil
+		}
+		if d, ok := c.s.dims[name]; ok {
+			// and dimension names to the element's position.
+			if j := c.v.dimIndex(d); j >= 0 {
+				return constant(c.v.index[j] + 1), nil
+			}
+		}
+	}
+	if !ok {
+		// builtins without arguments, like PI, may be
+		// written without parentheses.
+		if b, ok := LookupBuiltin(n.Name); ok && b.MinArgs == 0 {
+			return &call{b, nil}, nil
+		}
+		return nil, fmt.Errorf("unknown variable '%s'", n.Name)
+	}
+	return c.ref(v), nil
+}
+
+// ref returns a reference to v, recording it as a dependency.
+func (c *compiler) ref(v *variable) expr {
+	if !c.seen[v] {
+		c.seen[v] = true
+		c.v.deps = append(c.v.deps, v)
+	}
+	return &ref{v}
+}
+
+// funName returns the name of the function called by n, or a
+// placeholder if the function isn't a simple identifier.
+func funName(n *smile.CallExpr) string {
+	if id, ok := n.Fun.(*smile.Ident); ok {
+		return id.Name
+	}
+	return "<expr>"
+}
+
+const (
+	unvisited = iota
+	visiting
+	visited
+)
+
+// sort determines the order in which initial values are calculated,
+// and the order auxiliaries and flows are calculated at each time
+// step.  Stocks break dependency chains while running, but not when
+// calculating initial values.
+func (s *Sim) sort() error {
+	var err error
+	initDeps := func(v *variable) []*variable {
+		return append(v.deps[:len(v.deps):len(v.deps)], v.initDeps...)
+	}
+	if s.initials, err = s.topoSort(s.vars, initDeps, func(*variable) bool { return true }); err != nil {
+		return fmt.Errorf("initial values: %s", err)
+	}
+	var nonStocks []*variable
+	for _, v := range s.vars {
+		if v.kind != kindStock {
+			nonStocks = append(nonStocks, v)
+		}
+	}
+	deps := func(v *variable) []*variable { return v.deps }
+	s.flows, err = s.topoSort(nonStocks, deps, func(v *variable) bool { return v.kind != kindStock })
+	return err
+}
+
+// topoSort orders vars so that every variable comes after the
+// variables it depends on, as returned by deps.  Only dependencies
+// for which follow returns true are considered.
+func (s *Sim) topoSort(vars []*variable, deps func(*variable) []*variable, follow func(*variable) bool) ([]*variable, error) {
+	state := make(map[*variable]int, len(vars))
+	order := make([]*variable, 0, len(vars))
+
+	var visit func(v *variable) error
+	visit = func(v *variable) error {
+		switch state[v] {
+		case visiting:
+			return fmt.Errorf("circular dependency involving '%s'", v.name)
+		case visited:
+			return nil
+		}
+		state[v] = visiting
+		for _, d := range deps(v) {
+			if !follow(d) {
+				continue
+			}
+			if err := visit(d); err != nil {
+				return err
+			}
+		}
+		state[v] = visited
+		order = append(order, v)
+		return nil
+	}
+
+	for _, v := range vars {
+		if err := visit(v); err != nil {
+			return nil, err
+		}
+	}
+	return order, nil
+}
@@ -0,0 +1,350 @@
+// Copyright 2013 Bobby Powers. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package sim
+
+import (
+	"fmt"
+	"math"
+
+	"github.com/bpowers/go-xmile/smile"
+	"github.com/bpowers/go-xmile/xmile"
+)
+
+// conveyor is a stock through which material moves in a fixed
+// transit time.  Material enters the conveyor in a batch each time
+// step, and the batch leaves through the conveyor's outflow once it
+// has been on the conveyor for the transit time in effect when it
+// entered, less whatever leaked out on the way.  Conveyors are
+// updated once per time step, regardless of the integration method.
+type conveyor struct {
+	id      int // index into run.belts
+	stock   *variable
+	transit *variable
+	// capacity, inLimit, sample and arrest are nil if the
+	// conveyor doesn't use them.
+	capacity, inLimit, sample, arrest *variable
+	outflow                           *variable // nil if material stays on the end
+	leaks                             []*variable
+	leakStart, leakEnd                float64
+	exponential                       bool
+}
+
+// batch is the material that entered a conveyor in a single time
+// step.
+type batch struct {
+	amount  float64
+	entered float64 // amount when the batch entered
+	transit int     // transit time in time steps when the batch entered
+	steps   int     // time steps until the batch leaves
+}
+
+// belt is the state of a conveyor during a run.
+type belt struct {
+	batches   []batch // oldest first
+	fractions []float64
+	// the inflow, leak fractions, transit time and whether the
+	// conveyor is arrested at the start of the current time step.
+	inflow        float64
+	stepFractions []float64
+	transit       int
+	arrested      bool
+}
+
+// implicitAux adds an implicit auxiliary with the given equation,
+// whose names are resolved in the model as if it were part of owner's
+// equation.
+func (s *Sim) implicitAux(owner *variable, name, eqn string) (*variable, error) {
+	v := &variable{
+		name:     name,
+		kind:     kindAux,
+		implicit: true,
+		scope:    owner.scope,
+		array:    owner.array,
+		index:    owner.index,
+	}
+	var err error
+	if v.ast, err = smile.ParseExpr(s.fset, name, eqn); err != nil {
+		return nil, fmt.Errorf("smile.Parse(%s, '%s'): %s", name, eqn, err)
+	}
+	if err = s.check(v.ast); err != nil {
+		return nil, err
+	}
+	s.add(v)
+	return v, nil
+}
+
+func (s *Sim) compileConveyor(v *variable, xc *xmile.Conveyor) error {
+	switch {
+	case xc.Discrete != nil:
+		return fmt.Errorf("%s: discrete conveyors are not supported", v.name)
+	case xc.BatchIntegrity != nil:
+		return fmt.Errorf("%s: conveyors with batch integrity are not supported", v.name)
+	case xc.OneAtATime != nil:
+		return fmt.Errorf("%s: one at a time conveyors are not supported", v.name)
+	case xc.Len == "":
+		return fmt.Errorf("%s: conveyor without a len", v.name)
+	}
+	c := &conveyor{
+		id:          len(s.conveyors),
+		stock:       v,
+		leakStart:   xc.LeakStart,
+		leakEnd:     xc.LeakEnd,
+		exponential: xc.ExponentialLeak != nil,
+	}
+	if c.leakEnd == 0 {
+		c.leakEnd = 1
+	}
+	if c.leakStart < 0 || c.leakEnd > 1 || c.leakStart >= c.leakEnd {
+		return fmt.Errorf("%s: bad leak zone (%g to %g)", v.name, c.leakStart, c.leakEnd)
+	}
+
+	options := []struct {
+		v    **variable
+		name string
+		eqn  string
+	}{
+		{&c.transit, "len", xc.Len},
+		{&c.capacity, "capacity", xc.Capacity},
+		{&c.inLimit, "in_limit", xc.InLimit},
+		{&c.sample, "sample", xc.Sample},
+		{&c.arrest, "arrest", xc.Arrest},
+	}
+	for _, o := range options {
+		if o.eqn == "" {
+			continue
+		}
+		var err error
+		if *o.v, err = s.implicitAux(v, fmt.Sprintf("#%s.conveyor.%s", v.name, o.name), o.eqn); err != nil {
+			return err
+		}
+	}
+
+	for _, out := range v.outflows {
+		if out.conveyor != nil {
+			return fmt.Errorf("%s: '%s' already flows out of a conveyor", v.name, out.name)
+		}
+		out.conveyor = c
+		if out.leak {
+			c.leaks = append(c.leaks, out)
+		} else if c.outflow == nil {
+			c.outflow = out
+		} else {
+			return fmt.Errorf("%s: conveyors can only have one outflow that isn't a leak", v.name)
+		}
+	}
+	v.conveyor = c
+	s.conveyors = append(s.conveyors, c)
+	s.discrete = append(s.discrete, c)
+	return nil
+}
+
+// conveyorFlow compiles v, which flows out of a conveyor.  Leakage
+// flows' equations give the fraction that leaks.
+func (c *compiler) conveyorFlow(v *variable, eqn expr) expr {
+	cv := v.conveyor
+	if cv.arrest != nil {
+		c.ref(cv.arrest)
+	}
+	if !v.leak {
+		// the outflow is what remains of the batches leaving
+		// after leakage.
+		for _, l := range cv.leaks {
+			c.ref(l)
+		}
+		return &conveyorOutflow{cv}
+	}
+	for i, l := range cv.leaks {
+		if l == v {
+			return &leakage{cv, i, eqn}
+		}
+	}
+	panic("leak not found")
+}
+
+type (
+	conveyorOutflow struct {
+		c *conveyor
+	}
+
+	leakage struct {
+		c        *conveyor
+		i        int // index into conveyor.leaks
+		fraction expr
+	}
+)
+
+func (e *conveyorOutflow) eval(r *run) float64 {
+	c := e.c
+	b := &r.belts[c.id]
+	if c.arrested(r) {
+		return 0
+	}
+	var out float64
+	for _, bt := range b.batches {
+		if bt.steps <= 1 {
+			out += bt.amount - c.leaked(bt, b.fractions, r.dt)
+		}
+	}
+	return out / r.dt
+}
+
+func (e *leakage) eval(r *run) float64 {
+	c := e.c
+	b := &r.belts[c.id]
+	f := e.fraction.eval(r)
+	b.fractions[e.i] = f
+	if c.arrested(r) {
+		return 0
+	}
+	var leaked float64
+	for _, bt := range b.batches {
+		leaked += c.leak(bt, f, r.dt)
+	}
+	return leaked / r.dt
+}
+
+func (c *conveyor) arrested(r *run) bool {
+	return c.arrest != nil && r.curr[c.arrest.slot] != 0
+}
+
+// transitSteps returns the current transit time, rounded to a whole
+// number of time steps.
+func (c *conveyor) transitSteps(r *run) int {
+	return r.timeSteps(c.transit)
+}
+
+// timeSteps returns the current value of v, a length of time, rounded
+// to a whole number of time steps, and at least one.
+func (r *run) timeSteps(v *variable) int {
+	n := math.Floor(r.curr[v.slot]/r.dt + .5)
+	if n < 1 || math.IsNaN(n) {
+		return 1
+	}
+	return int(n)
+}
+
+// leak returns the amount of bt that leaks in a time step, with the
+// given leak fraction.  Linear leakage removes the fraction of what
+// entered the conveyor evenly over the leak zone, and exponential
+// leakage removes the fraction of the current amount per unit of
+// time.
+func (c *conveyor) leak(bt batch, f, dt float64) float64 {
+	n := float64(bt.transit)
+	// steps before the leak zone, and steps in it
+	start := math.Ceil(c.leakStart*n - timeEpsilon)
+	zone := math.Ceil(c.leakEnd*n-timeEpsilon) - start
+	elapsed := float64(bt.transit - bt.steps)
+	if elapsed < start || elapsed >= start+zone || f <= 0 {
+		return 0
+	}
+	var amount float64
+	if c.exponential {
+		amount = bt.amount * f * dt
+	} else {
+		amount = bt.entered * f / zone
+	}
+	return math.Min(amount, bt.amount)
+}
+
+// leaked returns the total amount of bt that leaks in a time step.
+func (c *conveyor) leaked(bt batch, fractions []float64, dt float64) float64 {
+	var total float64
+	for _, f := range fractions {
+		total += c.leak(bt, f, dt)
+	}
+	return math.Min(total, bt.amount)
+}
+
+// newBelt returns the state of an empty conveyor.
+func (c *conveyor) newBelt() belt {
+	return belt{
+		fractions:     make([]float64, len(c.leaks)),
+		stepFractions: make([]float64, len(c.leaks)),
+	}
+}
+
+// start spreads the conveyor's initial value evenly along it.
+func (c *conveyor) start(r *run) {
+	b := &r.belts[c.id]
+	n := c.transitSteps(r)
+	amount := r.curr[c.stock.slot] / float64(n)
+	b.batches = make([]batch, 0, n+1)
+	for i := 1; i <= n; i++ {
+		b.batches = append(b.batches, batch{amount, amount, n, i})
+	}
+}
+
+// limitFlows reduces the inflows of the conveyor, served in the order
+// they are listed, to what it can accept this time step.  Material
+// can't flow backwards onto a conveyor.
+func (c *conveyor) limitFlows(r *run) {
+	room := math.Inf(1)
+	switch {
+	case c.arrested(r), c.sample != nil && r.curr[c.sample.slot] == 0:
+		room = 0
+	case c.inLimit != nil:
+		room = math.Max(r.curr[c.inLimit.slot], 0) * r.dt
+	}
+	if c.capacity != nil {
+		contents := r.curr[c.stock.slot]
+		if c.outflow != nil {
+			contents -= r.curr[c.outflow.slot] * r.dt
+		}
+		for _, l := range c.leaks {
+			contents -= r.curr[l.slot] * r.dt
+		}
+		room = math.Min(room, math.Max(r.curr[c.capacity.slot]-contents, 0))
+	}
+	for _, in := range c.stock.inflows {
+		rate := math.Max(r.curr[in.slot], 0)
+		if rate*r.dt > room {
+			rate = room / r.dt
+		}
+		r.curr[in.slot] = rate
+		room -= rate * r.dt
+	}
+}
+
+// capture saves what the conveyor needs from the start of the time
+// step, as the Runge-Kutta methods recalculate flows part way through
+// it.
+func (c *conveyor) capture(r *run) {
+	b := &r.belts[c.id]
+	b.inflow = 0
+	for _, in := range c.stock.inflows {
+		b.inflow += r.curr[in.slot] * r.dt
+	}
+	copy(b.stepFractions, b.fractions)
+	b.transit = c.transitSteps(r)
+	b.arrested = c.arrested(r)
+}
+
+// update moves the conveyor along by a time step.
+func (c *conveyor) update(r *run) {
+	b := &r.belts[c.id]
+	if !b.arrested {
+		kept := b.batches[:0]
+		for _, bt := range b.batches {
+			bt.amount -= c.leaked(bt, b.stepFractions, r.dt)
+			// without an outflow, material stays on the
+			// end of the conveyor.
+			if bt.steps > 1 {
+				bt.steps--
+			} else if c.outflow != nil {
+				continue
+			}
+			kept = append(kept, bt)
+		}
+		b.batches = kept
+	}
+	if b.inflow > 0 {
+		b.batches = append(b.batches, batch{b.inflow, b.inflow, b.transit, b.transit})
+	}
+	var total float64
+	for _, bt := range b.batches {
+		total += bt.amount
+	}
+	r.curr[c.stock.slot] = total
+}
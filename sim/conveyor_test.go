@@ -0,0 +1,151 @@
+// Copyright 2013 Bobby Powers. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package sim_test
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/bpowers/go-xmile/sim"
+	"github.com/bpowers/go-xmile/xmile"
+)
+
+func conveyor(name, eqn string, c *xmile.Conveyor, inflows, outflows []string) *xmile.Variable {
+	v := stock(name, eqn, inflows, outflows)
+	v.Conveyor = c
+	return v
+}
+
+func leak(name, fraction string) *xmile.Variable {
+	v := flow(name, fraction)
+	v.Leak = new(xmile.Exister)
+	return v
+}
+
+func TestConveyor(t *testing.T) {
+	res := run(t, newFile(0, 5, 1,
+		conveyor("belt", "0", &xmile.Conveyor{Len: "3"}, []string{"in"}, []string{"out"}),
+		flow("in", "IF TIME < 2 THEN 10 ELSE 0"),
+		flow("out", ""),
+	))
+	expectSeries(t, res, "belt", []float64{0, 10, 20, 20, 10, 0})
+	expectSeries(t, res, "out", []float64{0, 0, 0, 10, 10, 0})
+}
+
+func TestConveyorInitialValue(t *testing.T) {
+	// the initial value is spread evenly along the conveyor
+	res := run(t, newFile(0, 5, 1,
+		conveyor("belt", "8", &xmile.Conveyor{Len: "4"}, nil, []string{"out"}),
+		flow("out", ""),
+	))
+	expectSeries(t, res, "belt", []float64{8, 6, 4, 2, 0, 0})
+	expectSeries(t, res, "out", []float64{2, 2, 2, 2, 0, 0})
+}
+
+func TestConveyorLeakage(t *testing.T) {
+	res := run(t, newFile(0, 3, 1,
+		conveyor("linear", "0", &xmile.Conveyor{Len: "2"}, []string{"in1"}, []string{"out1", "leak1"}),
+		flow("in1", "IF TIME = 0 THEN 10 ELSE 0"),
+		flow("out1", ""),
+		leak("leak1", ".5"),
+		conveyor("exponential", "0", &xmile.Conveyor{Len: "2", ExponentialLeak: new(xmile.Exister)},
+			[]string{"in2"}, []string{"out2", "leak2"}),
+		flow("in2", "IF TIME = 0 THEN 10 ELSE 0"),
+		flow("out2", ""),
+		leak("leak2", ".1"),
+	))
+	// half of what enters leaks out evenly along the conveyor
+	expectSeries(t, res, "linear", []float64{0, 10, 7.5, 0})
+	expectSeries(t, res, "leak1", []float64{0, 2.5, 2.5, 0})
+	expectSeries(t, res, "out1", []float64{0, 0, 5, 0})
+	// a tenth of what is on the conveyor leaks out per unit time
+	expectSeries(t, res, "exponential", []float64{0, 10, 9, 0})
+	expectSeries(t, res, "leak2", []float64{0, 1, .9, 0})
+	expectSeries(t, res, "out2", []float64{0, 0, 8.1, 0})
+}
+
+func TestConveyorLeakZone(t *testing.T) {
+	c := &xmile.Conveyor{Len: "4", LeakStart: .5}
+	res := run(t, newFile(0, 5, 1,
+		conveyor("belt", "0", c, []string{"in"}, []string{"out", "loss"}),
+		flow("in", "IF TIME = 0 THEN 8 ELSE 0"),
+		flow("out", ""),
+		leak("loss", ".25"),
+	))
+	// leakage only happens in the second half of the conveyor
+	expectSeries(t, res, "loss", []float64{0, 0, 0, 1, 1, 0})
+	expectSeries(t, res, "out", []float64{0, 0, 0, 0, 6, 0})
+}
+
+func TestConveyorTransitTimeChange(t *testing.T) {
+	// material keeps the transit time in effect when it entered
+	res := run(t, newFile(0, 4, 1,
+		conveyor("belt", "0", &xmile.Conveyor{Len: "IF TIME < 1 THEN 3 ELSE 1"},
+			[]string{"in"}, []string{"out"}),
+		flow("in", "IF TIME < 2 THEN 10 ELSE 0"),
+		flow("out", ""),
+	))
+	expectSeries(t, res, "belt", []float64{0, 10, 20, 10, 0})
+	expectSeries(t, res, "out", []float64{0, 0, 10, 10, 0})
+}
+
+func TestConveyorLimits(t *testing.T) {
+	res := run(t, newFile(0, 4, 1,
+		stock("source", "100", nil, []string{"load"}),
+		flow("load", "10"),
+		conveyor("full", "0", &xmile.Conveyor{Len: "3", Capacity: "15"},
+			[]string{"load"}, []string{"unload"}),
+		flow("unload", ""),
+		conveyor("slow", "0", &xmile.Conveyor{Len: "3", InLimit: "4"},
+			[]string{"trickle"}, nil),
+		flow("trickle", "10"),
+	))
+	expectSeries(t, res, "load", []float64{10, 5, 0, 10, 5})
+	// the limited flow is taken from the stock it drains
+	expectSeries(t, res, "source", []float64{100, 90, 85, 85, 75})
+	expectSeries(t, res, "full", []float64{0, 10, 15, 15, 15})
+	expectSeries(t, res, "trickle", []float64{4, 4, 4, 4, 4})
+	// without an outflow material collects on the end
+	expectSeries(t, res, "slow", []float64{0, 4, 8, 12, 16})
+}
+
+func TestConveyorArrestAndSample(t *testing.T) {
+	res := run(t, newFile(0, 5, 1,
+		conveyor("stopped", "0", &xmile.Conveyor{Len: "2", Arrest: "TIME >= 1 AND TIME < 3"},
+			[]string{"in1"}, []string{"out1"}),
+		flow("in1", "IF TIME = 0 THEN 10 ELSE 0"),
+		flow("out1", ""),
+		conveyor("sampled", "0", &xmile.Conveyor{Len: "2", Sample: "TIME = 1"},
+			[]string{"in2"}, []string{"out2"}),
+		flow("in2", "10"),
+		flow("out2", ""),
+	))
+	expectSeries(t, res, "out1", []float64{0, 0, 0, 0, 10, 0})
+	expectSeries(t, res, "in2", []float64{0, 10, 0, 0, 0, 0})
+	expectSeries(t, res, "out2", []float64{0, 0, 0, 10, 0, 0})
+}
+
+func TestConveyorErrors(t *testing.T) {
+	cases := []struct {
+		vars []*xmile.Variable
+		err  string
+	}{
+		{[]*xmile.Variable{
+			conveyor("c", "0", &xmile.Conveyor{Len: "1"}, nil, []string{"a", "b"}),
+			flow("a", ""), flow("b", ""),
+		}, "only have one outflow"},
+		{[]*xmile.Variable{
+			conveyor("c", "0", &xmile.Conveyor{Len: "1", Discrete: new(xmile.Exister)}, nil, nil),
+		}, "discrete conveyors are not supported"},
+		{[]*xmile.Variable{conveyor("c", "0", &xmile.Conveyor{}, nil, nil)}, "without a len"},
+		{[]*xmile.Variable{flow("a", "")}, "missing equation"},
+	}
+	for _, c := range cases {
+		_, err := sim.New(newFile(0, 1, 1, c.vars...))
+		if err == nil || !strings.Contains(err.Error(), c.err) {
+			t.Errorf("expected error containing '%s', got %v", c.err, err)
+		}
+	}
+}
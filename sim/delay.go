@@ -0,0 +1,117 @@
+// Copyright 2013 Bobby Powers. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package sim
+
+import (
+	"fmt"
+	"math"
+	"sort"
+
+	"github.com/bpowers/go-xmile/smile"
+)
+
+// pipeline is a call to DELAY, which returns its input as it was one
+// delay time ago.  Unlike DELAY1 and friends nothing is smoothed,
+// so rather than stocks a pipeline needs a history of its input.
+type pipeline struct {
+	id        int       // index into run.histories
+	input     *variable // implicit aux holding the call's input
+	delayTime expr
+	initial   expr // nil if the input's initial value is used
+}
+
+// history holds the input of a pipeline at the start of each time
+// step so far.
+type history struct {
+	time  []float64
+	value []float64
+}
+
+func compilePipeline(c *compiler, args []smile.Expr) (expr, error) {
+	s := c.s
+	in := &variable{
+		name:     fmt.Sprintf("#%s.delay#%d.input", c.v.name, c.v.instances),
+		kind:     kindAux,
+		ast:      args[0],
+		implicit: true,
+		scope:    c.v.scope,
+		array:    c.v.array,
+		index:    c.v.index,
+	}
+	c.v.instances++
+	s.add(in)
+
+	p := &pipeline{id: len(s.pipelines), input: in}
+	var err error
+	if p.delayTime, err = c.compile(args[1]); err != nil {
+		return nil, err
+	}
+	if len(args) > 2 {
+		if p.initial, err = c.compile(args[2]); err != nil {
+			return nil, err
+		}
+	} else {
+		c.v.initDeps = append(c.v.initDeps, in)
+	}
+	// the output depends only on past values of the input, so
+	// the input isn't one of the caller's deps.  This lets
+	// feedback loops be closed with a pipeline delay.
+	s.pipelines = append(s.pipelines, p)
+	return p, nil
+}
+
+func (p *pipeline) eval(r *run) float64 {
+	h := &r.histories[p.id]
+	if len(h.time) == 0 {
+		// calculating initial values
+		if p.initial != nil {
+			return p.initial.eval(r)
+		}
+		return r.curr[p.input.slot]
+	}
+
+	// delays shorter than a time step are treated as one time
+	// step, as the input for the current step may not have been
+	// calculated yet.
+	delay := math.Max(p.delayTime.eval(r), r.dt)
+	t := r.time - delay
+	if t < h.time[0]-timeEpsilon*r.dt {
+		if p.initial != nil {
+			return p.initial.eval(r)
+		}
+		return h.value[0]
+	}
+	return h.at(t)
+}
+
+// at returns the input at time t, interpolating linearly between
+// recorded values when t falls between time steps.
+func (h *history) at(t float64) float64 {
+	i := sort.SearchFloat64s(h.time, t)
+	switch {
+	case i == len(h.time):
+		return h.value[len(h.value)-1]
+	case h.time[i] == t || i == 0:
+		return h.value[i]
+	}
+	t0, t1 := h.time[i-1], h.time[i]
+	v0, v1 := h.value[i-1], h.value[i]
+	return v0 + (v1-v0)*(t-t0)/(t1-t0)
+}
+
+// record appends the current value of every pipeline's input to its
+// history.  It is called once at the start of each time step, after
+// flows have been calculated.
+func (r *run) record() {
+	for _, p := range r.s.pipelines {
+		h := &r.histories[p.id]
+		h.time = append(h.time, r.time)
+		h.value = append(h.value, r.curr[p.input.slot])
+	}
+}
+
+func init() {
+	register(&Builtin{Name: "DELAY", MinArgs: 2, MaxArgs: 3, compile: compilePipeline})
+}
@@ -0,0 +1,45 @@
+// Copyright 2013 Bobby Powers. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package sim_test
+
+import (
+	"testing"
+)
+
+func TestPipelineDelay(t *testing.T) {
+	res := run(t, newFile(0, 4, 1,
+		aux("x", "5 + TIME * 10"),
+		aux("with_initial", "DELAY(x, 2, -1)"),
+		aux("without_initial", "DELAY(x, 2)"),
+		// delays shorter than DT are one DT long
+		aux("short", "DELAY(x, .3)"),
+		aux("zero", "DELAY(x, 0, 0)"),
+	))
+	expectSeries(t, res, "with_initial", []float64{-1, -1, 5, 15, 25})
+	expectSeries(t, res, "without_initial", []float64{5, 5, 5, 15, 25})
+	expectSeries(t, res, "short", []float64{5, 5, 15, 25, 35})
+	expectSeries(t, res, "zero", []float64{0, 5, 15, 25, 35})
+}
+
+func TestPipelineChangingDelay(t *testing.T) {
+	res := run(t, newFile(0, 3, .5,
+		aux("x", "TIME * 10"),
+		aux("longer", "DELAY(x, 1 + STEP(1, 2), -1)"),
+		// between time steps the input is interpolated
+		aux("between", "DELAY(x, IF TIME >= 2 THEN 1.25 ELSE 1, -1)"),
+	))
+	expectSeries(t, res, "longer", []float64{-1, -1, 0, 5, 0, 5, 10})
+	expectSeries(t, res, "between", []float64{-1, -1, 0, 5, 7.5, 12.5, 17.5})
+}
+
+func TestPipelineFeedback(t *testing.T) {
+	// a and b form a loop that is only broken by the delay
+	res := run(t, newFile(0, 3, 1,
+		aux("a", "DELAY(b, 1, 0) + 1"),
+		aux("b", "a * 2"),
+	))
+	expectSeries(t, res, "a", []float64{1, 3, 7, 15})
+	expectSeries(t, res, "b", []float64{2, 6, 14, 30})
+}
@@ -0,0 +1,73 @@
+// Copyright 2013 Bobby Powers. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+/*
+The sim package simulates system dynamics models described by the
+xmile package.  Equations are parsed with the smile package,
+auxiliaries and flows are ordered by their dependencies, and stocks
+are integrated over the time span given by the file's SimSpec.
+
+Variable names are case-insensitive, and runs of spaces, newlines
+and underscores are treated as a single underscore, so the equation
+"hare__density" refers to the variable named "Hare_\ndensity".
+
+Arrayed variables are simulated as a separate variable for each
+element, named with the element's subscripts as in "pop[north,young]".
+In an apply-to-all equation, an array referred to without subscripts
+means the element with the same subscripts, a dimension name used as
+a subscript means the current element of that dimension, and a
+dimension name on its own is the position of the current element.
+Builtins like SUM and MEAN take arrays, such as pop[*, young], whose
+wildcard subscripts select every element of a dimension.  MIN, MAX
+and MEAN also take scalars, so when they have more than one argument
+only arguments with wildcards are arrays.  Check reports wildcards
+anywhere else.
+
+Modules are instances of other models in the file, simulated along
+with the model containing them.  A module's variables are named with
+the module's name as a prefix, as in "sub.stock", and can be referred
+to by those names from the containing model.  Each of a module's
+connections replaces the equation of its To variable with the value
+of its From variable, passing inputs into the module and outputs out
+of it.
+
+Functions from the XMILE standard library, like MAX and EXP, are
+described by Builtin values, and Check reports calls to unknown
+functions or calls with the wrong number of arguments.  Calls to
+stateful builtins like SMTH1 and DELAY3 are expanded into implicit
+stocks and flows, private to each call, which are simulated along
+with the rest of the model but are left out of Results.  DELAY,
+a pipeline delay, instead keeps a history of its input.
+
+Macros defined in the file can be called like builtins, and are
+expanded the same way: each call gets its own copy of the macro's
+equation and variables, in which the macro's parameters stand for
+the call's arguments.  Macros may call other macros, but not
+themselves.
+
+Random builtins like NORMAL and POISSON draw a new number once per
+time step.  Each call has its own stream of numbers, seeded from the
+Seed in the Options passed to RunWith and the name of the variable
+making the call, so runs with the same seed give identical results.
+A call's optional seed argument fixes its stream whatever the run's
+seed.  Options can also replace the values of the model's constants
+for a run, which the sensitivity package uses to run a model many
+times with its constants drawn from distributions.
+
+Conveyors are updated once per time step by moving their contents
+along, whatever the integration method.  Their outflows and leakage
+flows are calculated from the conveyor's contents at the start of the
+time step.
+
+Queues are also updated once per time step.  What enters through each
+inflow in a time step joins the back of the queue as a batch, and
+outflows, served in the order they are listed, take whole batches
+from the front.  A queue's overflow takes whatever its other outflows
+can't.
+
+Ovens, likewise updated once per time step, fill until their fill
+time has passed or they reach capacity, then cook for their cook time
+and release everything through their outflow in a single time step.
+*/
+package sim
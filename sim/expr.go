@@ -0,0 +1,132 @@
+// Copyright 2013 Bobby Powers. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package sim
+
+import (
+	"go/token"
+	"math"
+
+	"github.com/bpowers/go-xmile/xmile"
+)
+
+// expr is a compiled equation, or part of one.
+type expr interface {
+	eval(r *run) float64
+}
+
+type (
+	constant float64
+
+	// ref is a reference to the current value of a variable.
+	ref struct {
+		v *variable
+	}
+
+	unary struct {
+		op token.Token
+		x  expr
+	}
+
+	binary struct {
+		op   token.Token
+		x, y expr
+	}
+
+	// ifExpr evaluates only the branch selected by cond.
+	ifExpr struct {
+		cond, t, f expr
+	}
+
+	// nonNegative clamps the value of a uniflow at zero.
+	nonNegative struct {
+		x expr
+	}
+
+	// call is a call to a builtin function.
+	call struct {
+		b    *Builtin
+		args []expr
+	}
+
+	// lookup evaluates a graphical function with the value of x
+	// as input.
+	lookup struct {
+		t *xmile.Table
+		x expr
+	}
+)
+
+func (e constant) eval(r *run) float64 { return float64(e) }
+
+func (e *ref) eval(r *run) float64 { return r.curr[e.v.slot] }
+
+func (e *unary) eval(r *run) float64 {
+	x := e.x.eval(r)
+	switch e.op {
+	case token.SUB:
+		return -x
+	case token.NOT:
+		return boolean(x == 0)
+	}
+	return x
+}
+
+func (e *binary) eval(r *run) float64 {
+	x, y := e.x.eval(r), e.y.eval(r)
+	switch e.op {
+	case token.XOR:
+		return math.Pow(x, y)
+	case token.ADD:
+		return x + y
+	case token.SUB:
+		return x - y
+	case token.MUL:
+		return x * y
+	case token.QUO:
+		return x / y
+	case token.REM:
+		// the result has the same sign as the divisor
+		return x - y*math.Floor(x/y)
+	case token.EQL:
+		return boolean(x == y)
+	case token.NEQ:
+		return boolean(x != y)
+	case token.LSS:
+		return boolean(x < y)
+	case token.LEQ:
+		return boolean(x <= y)
+	case token.GTR:
+		return boolean(x > y)
+	case token.GEQ:
+		return boolean(x >= y)
+	case token.LAND:
+		return boolean(x != 0 && y != 0)
+	case token.LOR:
+		return boolean(x != 0 || y != 0)
+	}
+	return math.NaN()
+}
+
+// boolean converts b to the numeric form used in equations: 1 for
+// true and 0 for false.
+func boolean(b bool) float64 {
+	if b {
+		return 1
+	}
+	return 0
+}
+
+func (e *ifExpr) eval(r *run) float64 {
+	if e.cond.eval(r) != 0 {
+		return e.t.eval(r)
+	}
+	return e.f.eval(r)
+}
+
+func (e *nonNegative) eval(r *run) float64 { return math.Max(e.x.eval(r), 0) }
+
+func (e *call) eval(r *run) float64 { return e.b.eval(r, e.args) }
+
+func (e *lookup) eval(r *run) float64 { return e.t.Lookup(e.x.eval(r)) }
@@ -0,0 +1,289 @@
+// Copyright 2013 Bobby Powers. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package sim
+
+import (
+	"encoding/xml"
+	"fmt"
+	"go/token"
+	"math"
+	"strconv"
+	"strings"
+
+	"github.com/bpowers/go-xmile/smile"
+	"github.com/bpowers/go-xmile/xmile"
+)
+
+// template is a small model that a call to a stateful builtin, like
+// SMTH1, is expanded into.  Each call gets its own implicit copy of
+// the template's variables, whose equations refer to the call's
+// arguments by parameter name and to each other by name.
+type template struct {
+	params []string
+	// defaults holds equations for optional parameters, which
+	// may refer to earlier parameters.
+	defaults map[string]string
+	vars     []*xmile.Variable
+	output   string // the variable whose value the call returns
+}
+
+func implicitVar(kind, name, eqn string) *xmile.Variable {
+	return &xmile.Variable{XMLName: xml.Name{Local: kind}, Name: name, Eqn: eqn}
+}
+
+func implicitStock(name, eqn, inflow, outflow string) *xmile.Variable {
+	v := implicitVar("stock", name, eqn)
+	if inflow != "" {
+		v.Inflows = []string{inflow}
+	}
+	if outflow != "" {
+		v.Outflows = []string{outflow}
+	}
+	return v
+}
+
+// instantiate expands a call to a stateful builtin into a new
+// instance of the builtin's template, returning a reference to the
+// instance's output.
+func (c *compiler) instantiate(b *Builtin, call *smile.CallExpr) (expr, error) {
+	t, err := b.template(call.Args)
+	if err != nil {
+		return nil, err
+	}
+	for _, m := range c.v.expanding {
+		if m == b {
+			return nil, fmt.Errorf("macro %s calls itself", b.Name)
+		}
+	}
+	expanding := c.v.expanding
+	if _, ok := c.s.macros[b.Name]; ok {
+		expanding = append(expanding[:len(expanding):len(expanding)], b)
+	}
+
+	s := c.s
+	prefix := fmt.Sprintf("#%s.%s#%d.", c.v.name, strings.ToLower(b.Name), c.v.instances)
+	c.v.instances++
+
+	scope := make(map[string]*variable)
+	for i, p := range t.params {
+		// arguments are evaluated in the scope of the call,
+		// defaults in the scope of the template.
+		v := &variable{
+			name:      prefix + p,
+			kind:      kindAux,
+			implicit:  true,
+			scope:     c.v.scope,
+			array:     c.v.array,
+			index:     c.v.index,
+			expanding: c.v.expanding,
+		}
+		if i < len(call.Args) {
+			v.ast = call.Args[i]
+		} else if def, ok := t.defaults[p]; ok {
+			v.scope = scope
+			v.expanding = expanding
+			if v.ast, err = smile.ParseExpr(s.fset, v.name, def); err != nil {
+				return nil, fmt.Errorf("%s: %s", v.name, err)
+			}
+		} else {
+			return nil, fmt.Errorf("%s: missing argument '%s'", b.Name, p)
+		}
+		s.add(v)
+		scope[p] = v
+	}
+
+	for _, tv := range t.vars {
+		xv := *tv
+		xv.Name = prefix + tv.Name
+		v, err := s.declare(&xv)
+		if err != nil {
+			return nil, err
+		}
+		v.implicit = true
+		v.scope = scope
+		v.expanding = expanding
+		s.add(v)
+		scope[CanonicalName(tv.Name)] = v
+	}
+	for _, tv := range t.vars {
+		v := scope[CanonicalName(tv.Name)]
+		if v.kind != kindStock {
+			continue
+		}
+		if v.inflows, err = s.flowList(v, tv.Inflows); err != nil {
+			return nil, err
+		}
+		if v.outflows, err = s.flowList(v, tv.Outflows); err != nil {
+			return nil, err
+		}
+	}
+
+	return c.ref(scope[t.output]), nil
+}
+
+// constValue returns the value of x if it is a constant expression
+// made of numbers and arithmetic operators.
+func constValue(x smile.Expr) (float64, bool) {
+	return foldConst(x, nil)
+}
+
+// foldConst is like constValue, but also folds the identifiers that
+// ident, if not nil, gives a value for.
+func foldConst(x smile.Expr, ident func(*smile.Ident) (float64, bool)) (float64, bool) {
+	switch x := x.(type) {
+	case *smile.Ident:
+		if ident != nil {
+			return ident(x)
+		}
+	case *smile.BasicLit:
+		f, err := strconv.ParseFloat(x.Value, 64)
+		return f, err == nil
+	case *smile.ParenExpr:
+		return foldConst(x.X, ident)
+	case *smile.UnaryExpr:
+		v, ok := foldConst(x.X, ident)
+		if x.Op == token.SUB {
+			v = -v
+		}
+		return v, ok && (x.Op == token.SUB || x.Op == token.ADD)
+	case *smile.BinaryExpr:
+		a, okA := foldConst(x.X, ident)
+		b, okB := foldConst(x.Y, ident)
+		if !okA || !okB {
+			return 0, false
+		}
+		switch x.Op {
+		case token.ADD:
+			return a + b, true
+		case token.SUB:
+			return a - b, true
+		case token.MUL:
+			return a * b, true
+		case token.QUO:
+			return a / b, true
+		case token.XOR:
+			return math.Pow(a, b), true
+		}
+	}
+	return 0, false
+}
+
+// order returns the constant order argument of DELAYN and SMTHN.
+func order(name string, x smile.Expr) (int, error) {
+	n, ok := constValue(x)
+	if !ok {
+		return 0, fmt.Errorf("%s: order must be a constant", name)
+	}
+	n = math.Floor(n + .5)
+	if n < 1 {
+		return 0, fmt.Errorf("%s: order must be at least 1, not %g", name, n)
+	}
+	return int(n), nil
+}
+
+// smthN returns a template for an nth order exponential smooth: a
+// chain of n stocks, each adjusting towards the previous one over
+// 1/n of the averaging time.
+func smthN(n int) *template {
+	t := &template{
+		params:   []string{"input", "averaging_time", "order", "initial"},
+		defaults: map[string]string{"initial": "input"},
+	}
+	prev := "input"
+	for i := 1; i <= n; i++ {
+		stock := fmt.Sprintf("stock%d", i)
+		change := fmt.Sprintf("change%d", i)
+		t.vars = append(t.vars,
+			implicitStock(stock, "initial", change, ""),
+			implicitVar("flow", change,
+				fmt.Sprintf("(%s - %s) / (averaging_time / %d)", prev, stock, n)))
+		prev = stock
+	}
+	t.output = prev
+	return t
+}
+
+// delayN returns a template for an nth order material delay: a chain
+// of n stocks, each draining into the next over 1/n of the delay
+// time.
+func delayN(n int) *template {
+	t := &template{
+		params:   []string{"input", "delay_time", "order", "initial"},
+		defaults: map[string]string{"initial": "input"},
+		vars:     []*xmile.Variable{implicitVar("flow", "flow0", "input")},
+	}
+	for i := 1; i <= n; i++ {
+		stock := fmt.Sprintf("stock%d", i)
+		in, out := fmt.Sprintf("flow%d", i-1), fmt.Sprintf("flow%d", i)
+		t.vars = append(t.vars,
+			implicitStock(stock, fmt.Sprintf("initial * delay_time / %d", n), in, out),
+			implicitVar("flow", out, fmt.Sprintf("%s / (delay_time / %d)", stock, n)))
+	}
+	t.output = fmt.Sprintf("flow%d", n)
+	return t
+}
+
+// fixedOrder adapts a template with an order parameter for builtins
+// like SMTH3, where the order is implied rather than passed, so that
+// the builtin's third argument is the initial value.
+func fixedOrder(gen func(int) *template, n int) func([]smile.Expr) (*template, error) {
+	return func([]smile.Expr) (*template, error) {
+		t := gen(n)
+		t.params = append(t.params[:2:2], t.params[3:]...)
+		return t, nil
+	}
+}
+
+// variableOrder adapts a template for builtins like DELAYN, whose
+// third argument is a constant order.
+func variableOrder(name string, gen func(int) *template) func([]smile.Expr) (*template, error) {
+	return func(args []smile.Expr) (*template, error) {
+		n, err := order(name, args[2])
+		if err != nil {
+			return nil, err
+		}
+		return gen(n), nil
+	}
+}
+
+// trend returns a template for the fractional rate of change of the
+// input, relative to its exponential average.  If forecast is true
+// the template extrapolates the input over a horizon with that
+// trend.
+func trend(forecast bool) func([]smile.Expr) (*template, error) {
+	return func([]smile.Expr) (*template, error) {
+		t := &template{
+			params:   []string{"input", "averaging_time", "initial"},
+			defaults: map[string]string{"initial": "0"},
+			vars: []*xmile.Variable{
+				implicitStock("average", "input / (1 + initial * averaging_time)", "change", ""),
+				implicitVar("flow", "change", "(input - average) / averaging_time"),
+				implicitVar("aux", "trend", "(input - average) / (average * averaging_time)"),
+			},
+			output: "trend",
+		}
+		if forecast {
+			t.params = []string{"input", "averaging_time", "horizon", "initial"}
+			t.vars = append(t.vars, implicitVar("aux", "forecast", "input * (1 + trend * horizon)"))
+			t.output = "forecast"
+		}
+		return t, nil
+	}
+}
+
+func init() {
+	for _, b := range []*Builtin{
+		{Name: "DELAY1", MinArgs: 2, MaxArgs: 3, template: fixedOrder(delayN, 1)},
+		{Name: "DELAY3", MinArgs: 2, MaxArgs: 3, template: fixedOrder(delayN, 3)},
+		{Name: "DELAYN", MinArgs: 3, MaxArgs: 4, template: variableOrder("DELAYN", delayN)},
+		{Name: "FORCST", MinArgs: 3, MaxArgs: 4, template: trend(true)},
+		{Name: "SMTH1", MinArgs: 2, MaxArgs: 3, template: fixedOrder(smthN, 1)},
+		{Name: "SMTH3", MinArgs: 2, MaxArgs: 3, template: fixedOrder(smthN, 3)},
+		{Name: "SMTHN", MinArgs: 3, MaxArgs: 4, template: variableOrder("SMTHN", smthN)},
+		{Name: "TREND", MinArgs: 2, MaxArgs: 3, template: trend(false)},
+	} {
+		register(b)
+	}
+}
@@ -0,0 +1,74 @@
+// Copyright 2013 Bobby Powers. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package sim_test
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/bpowers/go-xmile/sim"
+)
+
+func TestSmooth(t *testing.T) {
+	res := run(t, newFile(0, 3, 1,
+		aux("x", "10"),
+		aux("from_zero", "SMTH1(x, 2, 0)"),
+		aux("from_input", "SMTH1(x, 2)"),
+		// each call has its own state
+		aux("two", "SMTH1(x, 2, 0) + SMTH1(x, 2, 10)"),
+	))
+	expectSeries(t, res, "from_zero", []float64{0, 5, 7.5, 8.75})
+	expectSeries(t, res, "from_input", []float64{10, 10, 10, 10})
+	expectSeries(t, res, "two", []float64{10, 15, 17.5, 18.75})
+	for name := range res.Values {
+		if strings.Contains(name, "#") {
+			t.Errorf("implicit variable '%s' in results", name)
+		}
+	}
+}
+
+func TestStatefulBuiltins(t *testing.T) {
+	// x steps from 2 to 10 at t=1
+	res := run(t, newFile(0, 4, .5,
+		aux("x", "2 + STEP(8, 1)"),
+		aux("smth3", "SMTH3(x, 3, 0)"),
+		aux("smthn", "SMTHN(x, 3, 3, 0)"),
+		aux("delay1", "DELAY1(x, 2)"),
+		aux("delay3", "DELAY3(x, 2)"),
+		aux("delayn", "DELAYN(x, 2, 3)"),
+		aux("trend", "TREND(x, 2, .1)"),
+		aux("forcst", "FORCST(x, 2, 4)"),
+	))
+	smth3 := []float64{0, 0, 0, 0.25, 0.625, 2, 3.8125, 5.546875, 6.9609375}
+	delay3 := []float64{2, 2, 2, 2, 2, 5.375, 7.90625, 9.171875, 9.69921875}
+	expectSeries(t, res, "smth3", smth3)
+	expectSeries(t, res, "smthn", smth3)
+	expectSeries(t, res, "delay1", []float64{2, 2, 2, 4, 5.5, 6.625, 7.46875, 8.1015625, 8.576171875})
+	expectSeries(t, res, "delay3", delay3)
+	expectSeries(t, res, "delayn", delay3)
+	expectSeries(t, res, "trend", []float64{0.1, 1.0 / 14, 131.0 / 58,
+		0.795546558704, 0.426864590876, 0.263837087871, 0.174816303667,
+		0.120573151424, 0.085288134019})
+	expectSeries(t, res, "forcst", []float64{2, 2, 90, 40, 290.0 / 11,
+		20.1886792453, 16.7782426778, 14.6865959499, 13.3204281485})
+}
+
+func TestStatefulErrors(t *testing.T) {
+	cases := []struct {
+		eqn string
+		err string
+	}{
+		{"DELAYN(x, 2, x)", "order must be a constant"},
+		{"DELAYN(x, 2, 0)", "order must be at least 1"},
+		{"SMTH1(x)", "SMTH1 takes at least 2 arguments"},
+		{"SMTH1(y, 2)", "unknown variable 'y'"},
+	}
+	for _, c := range cases {
+		_, err := sim.New(newFile(0, 1, 1, aux("x", "1"), aux("z", c.eqn)))
+		if err == nil || !strings.Contains(err.Error(), c.err) {
+			t.Errorf("%s: expected error containing '%s', got %v", c.eqn, c.err, err)
+		}
+	}
+}
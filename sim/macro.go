@@ -0,0 +1,92 @@
+// Copyright 2013 Bobby Powers. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package sim
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/bpowers/go-xmile/smile"
+	"github.com/bpowers/go-xmile/xmile"
+)
+
+// macroOutput names the implicit variable holding a macro's equation,
+// which can't clash with the names of the macro's own variables.
+const macroOutput = "#output"
+
+// declareMacros makes each of the file's macros available to the
+// model's equations as a function.  Macros are expanded like stateful
+// builtins: the macro's equation and variables become a template, and
+// each call gets its own copy of them.
+func (s *Sim) declareMacros(macros []*xmile.Macro) error {
+	for _, xm := range macros {
+		name := strings.ToUpper(CanonicalName(xm.Name))
+		if name == "" {
+			return fmt.Errorf("macro with an empty name")
+		} else if _, ok := LookupBuiltin(name); ok {
+			return fmt.Errorf("macro %s: a builtin has the same name", name)
+		} else if _, ok := s.macros[name]; ok {
+			return fmt.Errorf("macro %s: duplicate macro name", name)
+		} else if strings.TrimSpace(xm.Eqn) == "" {
+			return fmt.Errorf("macro %s: missing equation", name)
+		}
+
+		t := &template{
+			defaults: make(map[string]string),
+			output:   macroOutput,
+		}
+		b := &Builtin{Name: name}
+		params := make(map[string]bool)
+		for _, p := range xm.Parms {
+			pn := CanonicalName(p.Name)
+			if pn == "" {
+				return fmt.Errorf("macro %s: parameter with an empty name", name)
+			} else if params[pn] {
+				return fmt.Errorf("macro %s: duplicate parameter '%s'", name, pn)
+			}
+			params[pn] = true
+			t.params = append(t.params, pn)
+			if strings.TrimSpace(p.Default) != "" {
+				t.defaults[pn] = p.Default
+			} else if len(t.defaults) > 0 {
+				return fmt.Errorf("macro %s: parameter '%s' follows one with a default", name, pn)
+			} else {
+				b.MinArgs++
+			}
+		}
+		b.MaxArgs = len(t.params)
+
+		for _, xv := range xm.Variables {
+			if xv.XMLName.Local == "module" || len(xv.Dimensions) > 0 {
+				return fmt.Errorf("macro %s: %s: only scalar stocks, flows and auxiliaries are supported",
+					name, xv.Name)
+			} else if params[CanonicalName(xv.Name)] {
+				return fmt.Errorf("macro %s: '%s' is both a parameter and a variable", name, xv.Name)
+			}
+			t.vars = append(t.vars, xv)
+		}
+		t.vars = append(t.vars, implicitVar("aux", macroOutput, xm.Eqn))
+
+		b.template = func([]smile.Expr) (*template, error) {
+			return t, nil
+		}
+		s.macros[name] = b
+	}
+	return nil
+}
+
+// function returns the macro or builtin with the given name, which is
+// case-insensitive.  Macros are looked up first.
+func (s *Sim) function(name string) (*Builtin, bool) {
+	if b, ok := s.macros[strings.ToUpper(CanonicalName(name))]; ok {
+		return b, true
+	}
+	return LookupBuiltin(name)
+}
+
+// check is like Check, but knows about the file's macros.
+func (s *Sim) check(x smile.Expr) error {
+	return check(s.fset, x, s.function)
+}
@@ -0,0 +1,128 @@
+// Copyright 2013 Bobby Powers. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package sim_test
+
+import (
+	"encoding/xml"
+	"strings"
+	"testing"
+
+	"github.com/bpowers/go-xmile/sim"
+	"github.com/bpowers/go-xmile/xmile"
+)
+
+// macro returns a macro with the given parameters, written as "name"
+// or "name=default".
+func macro(name, eqn string, params []string, vars ...*xmile.Variable) *xmile.Macro {
+	m := &xmile.Macro{XMLName: xml.Name{Local: "macro"}, Name: name, Eqn: eqn, Variables: vars}
+	for _, p := range params {
+		parm := &xmile.Parm{Name: p}
+		if i := strings.IndexByte(p, '='); i >= 0 {
+			parm.Name, parm.Default = p[:i], p[i+1:]
+		}
+		m.Parms = append(m.Parms, parm)
+	}
+	return m
+}
+
+// accumulate is a macro with a stock, which adds up its input.
+func accumulate() *xmile.Macro {
+	return macro("accumulate", "total", []string{"input"},
+		stock("total", "0", []string{"adding"}, nil),
+		flow("adding", "input"),
+	)
+}
+
+func TestMacros(t *testing.T) {
+	f := newFile(0, 3, 1,
+		aux("doubled", "double(3)"),
+		aux("scaled", "SCALE(3) + SCALE(3, 3)"),
+		aux("nested", "Twice_Double(1)"),
+		aux("rate", "2"),
+		// each call has its own stock
+		aux("sum", "ACCUMULATE(rate)"),
+		aux("sums", "ACCUMULATE(1) + ACCUMULATE(10)"),
+	)
+	f.Macros = []*xmile.Macro{
+		macro("DOUBLE", "x * 2", []string{"x"}),
+		macro("scale", "x * by", []string{"x", "by=x - 1"}),
+		macro("twice double", "DOUBLE(DOUBLE(x))", []string{"x"}),
+		accumulate(),
+	}
+	res := run(t, f)
+	expectSeries(t, res, "doubled", []float64{6, 6, 6, 6})
+	expectSeries(t, res, "scaled", []float64{15, 15, 15, 15})
+	expectSeries(t, res, "nested", []float64{4, 4, 4, 4})
+	expectSeries(t, res, "sum", []float64{0, 2, 4, 6})
+	expectSeries(t, res, "sums", []float64{0, 11, 22, 33})
+	if len(res.Values) != 6 {
+		t.Errorf("expected 6 series, not %d", len(res.Values))
+	}
+}
+
+func TestMacroXML(t *testing.T) {
+	const contents = `<xmile xmlns="http://www.systemdynamics.org/XMILE" version="1.0" level="3">
+  <header><name>test</name></header>
+  <sim_specs><start>0</start><stop>2</stop><dt>1</dt></sim_specs>
+  <model><variables><aux name="x"><eqn>COUNTER(5)</eqn></aux></variables></model>
+  <macro name="COUNTER">
+    <parm>step</parm>
+    <parm default="0">start</parm>
+    <eqn>count</eqn>
+    <variables>
+      <stock name="count"><eqn>start</eqn><inflow>counting</inflow></stock>
+      <flow name="counting"><eqn>step</eqn></flow>
+    </variables>
+  </macro>
+</xmile>`
+	f := new(xmile.File)
+	if err := xml.Unmarshal([]byte(contents), f); err != nil {
+		t.Fatalf("xml.Unmarshal: %s", err)
+	}
+	if len(f.Macros) != 1 || len(f.Macros[0].Parms) != 2 || f.Macros[0].Parms[1].Default != "0" {
+		t.Fatalf("bad macro %+v", f.Macros)
+	}
+	res := run(t, f)
+	expectSeries(t, res, "x", []float64{0, 5, 10})
+}
+
+func TestMacroErrors(t *testing.T) {
+	cases := []struct {
+		eqn    string
+		macros []*xmile.Macro
+		err    string
+	}{
+		{"DOUBLE(1, 2)", []*xmile.Macro{macro("double", "x * 2", []string{"x"})},
+			"DOUBLE takes 1 argument, not 2"},
+		{"SCALE()", []*xmile.Macro{macro("scale", "x * by", []string{"x", "by=2"})},
+			"SCALE takes at least 1 argument, not 0"},
+		{"LOOP(1)", []*xmile.Macro{macro("loop", "LOOP(x)", []string{"x"})},
+			"macro LOOP calls itself"},
+		{"PING(1)", []*xmile.Macro{
+			macro("ping", "PONG(x)", []string{"x"}),
+			macro("pong", "PING(x)", []string{"x"}),
+		}, "macro PING calls itself"},
+		{"1", []*xmile.Macro{macro("max", "x", []string{"x"})},
+			"macro MAX: a builtin has the same name"},
+		{"1", []*xmile.Macro{macro("f", "x", []string{"x"}), macro("F", "x", []string{"x"})},
+			"macro F: duplicate macro name"},
+		{"1", []*xmile.Macro{macro("f", "", []string{"x"})}, "macro F: missing equation"},
+		{"1", []*xmile.Macro{macro("f", "x", []string{"x=1", "y"})},
+			"parameter 'y' follows one with a default"},
+		{"1", []*xmile.Macro{macro("f", "x", []string{"x"}, aux("x", "1"))},
+			"'x' is both a parameter and a variable"},
+		{"F(1)", []*xmile.Macro{macro("f", "x + y", []string{"x"})},
+			"unknown variable 'y'"},
+		{"UNDEFINED(1)", nil, "unknown function 'UNDEFINED'"},
+	}
+	for _, c := range cases {
+		f := newFile(0, 1, 1, aux("y", "1"), aux("z", c.eqn))
+		f.Macros = c.macros
+		_, err := sim.New(f)
+		if err == nil || !strings.Contains(err.Error(), c.err) {
+			t.Errorf("%s: expected error containing '%s', got %v", c.eqn, c.err, err)
+		}
+	}
+}
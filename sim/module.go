@@ -0,0 +1,133 @@
+// Copyright 2013 Bobby Powers. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package sim
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/bpowers/go-xmile/xmile"
+)
+
+// decl pairs a variable with its definition.
+type decl struct {
+	xv *xmile.Variable
+	v  *variable
+}
+
+// module is an instance of a model within another model.
+type module struct {
+	xv     *xmile.Variable
+	parent map[string]*variable // the scope of the containing model, or nil
+}
+
+// declareModel declares the variables of m, appending them to decls.
+// The variables of a module are named with the module's name and a
+// dot as a prefix, and are resolved in a scope of their own, in
+// which the variables of the module's own modules are available by
+// their qualified names.  stack holds the models being declared, to
+// catch modules that include themselves.
+func (s *Sim) declareModel(m *xmile.Model, prefix string, scope map[string]*variable,
+	stack []*xmile.Model, decls *[]decl, modules *[]module) error {
+
+	for _, mm := range stack {
+		if mm == m {
+			return fmt.Errorf("module '%s' contains itself", strings.TrimSuffix(prefix, "."))
+		}
+	}
+	stack = append(stack, m)
+
+	for _, xv := range m.Variables {
+		if xv.XMLName.Local == "module" {
+			if err := s.declareModule(xv, prefix, scope, stack, decls, modules); err != nil {
+				return err
+			}
+			continue
+		}
+		if prefix != "" {
+			if len(xv.Dimensions) > 0 {
+				return fmt.Errorf("%s%s: arrayed variables in modules are not supported", prefix, xv.Name)
+			}
+			xe := *xv
+			xe.Name = prefix + xv.Name
+			xv = &xe
+		}
+		vs, err := s.declareAll(xv)
+		if err != nil {
+			return err
+		}
+		for _, v := range vs {
+			v.scope = scope
+			s.add(v)
+			if scope != nil {
+				scope[strings.TrimPrefix(v.name, prefix)] = v
+			}
+			*decls = append(*decls, decl{xv, v})
+		}
+	}
+	return nil
+}
+
+// declareModule declares the variables of the model that xv, a
+// module, is an instance of.
+func (s *Sim) declareModule(xv *xmile.Variable, prefix string, scope map[string]*variable,
+	stack []*xmile.Model, decls *[]decl, modules *[]module) error {
+
+	name := CanonicalName(xv.Name)
+	if name == "" {
+		return fmt.Errorf("module with an empty name")
+	}
+	modelName := xv.Model
+	if modelName == "" {
+		modelName = xv.Name
+	}
+	var m *xmile.Model
+	for _, mm := range s.models {
+		if CanonicalName(mm.Name) == CanonicalName(modelName) {
+			m = mm
+			break
+		}
+	}
+	if m == nil {
+		return fmt.Errorf("%s%s: unknown model '%s'", prefix, name, modelName)
+	}
+
+	inner := make(map[string]*variable)
+	if err := s.declareModel(m, prefix+name+".", inner, stack, decls, modules); err != nil {
+		return err
+	}
+	if scope != nil {
+		for n, v := range inner {
+			scope[name+"."+n] = v
+		}
+	}
+	*modules = append(*modules, module{xv, scope})
+	return nil
+}
+
+// connect wires up the inputs and outputs of a module, replacing the
+// equation of each connection's To with a reference to its From.
+func (s *Sim) connect(mod module) error {
+	for _, p := range mod.xv.Params {
+		if p.XMLName.Local != "connect" {
+			continue
+		}
+		to, ok := s.lookup(mod.parent, p.To)
+		if !ok {
+			return fmt.Errorf("%s: unknown variable '%s' in connection", mod.xv.Name, p.To)
+		}
+		from, ok := s.lookup(mod.parent, p.From)
+		if !ok {
+			return fmt.Errorf("%s: unknown variable '%s' in connection", mod.xv.Name, p.From)
+		}
+		if to.kind == kindStock {
+			return fmt.Errorf("%s: can't connect to stock '%s'", mod.xv.Name, p.To)
+		} else if to.alias != nil {
+			return fmt.Errorf("%s: '%s' is connected twice", mod.xv.Name, p.To)
+		}
+		to.alias = from
+	}
+	return nil
+}
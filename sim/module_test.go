@@ -0,0 +1,105 @@
+// Copyright 2013 Bobby Powers. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package sim_test
+
+import (
+	"encoding/xml"
+	"strings"
+	"testing"
+
+	"github.com/bpowers/go-xmile/sim"
+	"github.com/bpowers/go-xmile/xmile"
+)
+
+// module returns an instance of the named model, with connections
+// given as to, from pairs.
+func module(name, model string, connections ...string) *xmile.Variable {
+	v := &xmile.Variable{XMLName: xml.Name{Local: "module"}, Name: name, Model: model}
+	for i := 0; i+1 < len(connections); i += 2 {
+		v.Params = append(v.Params, &xmile.Connect{
+			XMLName: xml.Name{Local: "connect"},
+			To:      connections[i],
+			From:    connections[i+1],
+		})
+	}
+	return v
+}
+
+func model(name string, vars ...*xmile.Variable) *xmile.Model {
+	return &xmile.Model{Name: name, Variables: vars}
+}
+
+// growth is a model with an input, rate, which defaults to 0.1.
+func growth() *xmile.Model {
+	return model("growth",
+		stock("stock", "10", []string{"change"}, nil),
+		flow("change", "stock * rate"),
+		aux("rate", ".1"),
+	)
+}
+
+func TestModules(t *testing.T) {
+	f := newFile(0, 2, 1,
+		aux("rate", ".5"),
+		module("Growth", "", "growth.rate", "rate", "pop", "growth.stock"),
+		aux("pop", ""),
+		aux("double", "growth.stock * 2"),
+		// a second, unconnected, instance
+		module("slow", "growth"),
+	)
+	f.Models = append(f.Models, growth())
+	res := run(t, f)
+	expectSeries(t, res, "growth.stock", []float64{10, 15, 22.5})
+	expectSeries(t, res, "growth.rate", []float64{.5, .5, .5})
+	expectSeries(t, res, "pop", []float64{10, 15, 22.5})
+	expectSeries(t, res, "double", []float64{20, 30, 45})
+	expectSeries(t, res, "slow.stock", []float64{10, 11, 12.1})
+}
+
+func TestNestedModules(t *testing.T) {
+	f := newFile(0, 2, 1,
+		module("o", "outer", "o.growth_rate", "rate"),
+		aux("rate", ".5"),
+		aux("big", "o.big"),
+	)
+	f.Models = append(f.Models,
+		model("outer",
+			aux("growth_rate", ".1"),
+			module("inner", "growth", "inner.rate", "growth_rate"),
+			aux("big", "inner.stock * 10"),
+		),
+		growth(),
+	)
+	res := run(t, f)
+	expectSeries(t, res, "o.inner.stock", []float64{10, 15, 22.5})
+	expectSeries(t, res, "big", []float64{100, 150, 225})
+}
+
+func TestModuleErrors(t *testing.T) {
+	cases := []struct {
+		vars   []*xmile.Variable
+		models []*xmile.Model
+		err    string
+	}{
+		{[]*xmile.Variable{module("m", "nowhere")}, nil, "m: unknown model 'nowhere'"},
+		{[]*xmile.Variable{module("m", "loop")},
+			[]*xmile.Model{model("loop", module("again", "loop"))},
+			"module 'm.again' contains itself"},
+		{[]*xmile.Variable{module("growth", "", "growth.nothing", "x"), aux("x", "1")},
+			[]*xmile.Model{growth()}, "unknown variable 'growth.nothing' in connection"},
+		{[]*xmile.Variable{module("growth", "", "growth.stock", "x"), aux("x", "1")},
+			[]*xmile.Model{growth()}, "can't connect to stock 'growth.stock'"},
+		{[]*xmile.Variable{module("growth", ""), aux("x", "stock")},
+			[]*xmile.Model{growth()}, "unknown variable 'stock'"},
+	}
+	for _, c := range cases {
+		f := newFile(0, 1, 1, c.vars...)
+		f.Models = append(f.Models, c.models...)
+		_, err := sim.New(f)
+		if err == nil || !strings.Contains(err.Error(), c.err) {
+			t.Errorf("expected error containing '%s', got %v", c.err, err)
+		}
+	}
+}
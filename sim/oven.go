@@ -0,0 +1,201 @@
+// Copyright 2013 Bobby Powers. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package sim
+
+import (
+	"fmt"
+	"math"
+
+	"github.com/bpowers/go-xmile/xmile"
+)
+
+// oven is a stock that processes material in batches.  An empty
+// oven is idle until material flows in, and then fills for the fill
+// time or until it reaches its capacity.  It then cooks, accepting
+// nothing, for the cook time, and releases everything through its
+// outflow over the following time step, after which it is idle
+// again.  Ovens are updated once per time step, regardless of the
+// integration method.
+type oven struct {
+	id                 int // index into run.bakes
+	stock              *variable
+	capacity           *variable // nil if there is no limit
+	fillTime, cookTime *variable
+	outflow            *variable // nil if material stays in the oven
+	interleaving       bool
+}
+
+type ovenState int
+
+const (
+	ovenIdle ovenState = iota
+	ovenFilling
+	ovenCooking
+	ovenUnloading
+)
+
+// bake is the state of an oven during a run.
+type bake struct {
+	state    ovenState
+	contents float64
+	steps    int // time steps spent filling or cooking so far
+	// the inflow, capacity, and fill and cook times in time steps,
+	// at the start of the current time step.
+	inflow, capacity     float64
+	fillSteps, cookSteps int
+}
+
+func (s *Sim) compileOven(v *variable, xo *xmile.Oven) error {
+	switch {
+	case xo.FillTime == "":
+		return fmt.Errorf("%s: oven without a fill_time", v.name)
+	case xo.CookTime == "":
+		return fmt.Errorf("%s: oven without a cook_time", v.name)
+	case len(v.outflows) > 1:
+		return fmt.Errorf("%s: ovens can only have one outflow", v.name)
+	}
+	o := &oven{
+		id:           len(s.ovens),
+		stock:        v,
+		interleaving: xo.Interleaving != nil,
+	}
+
+	options := []struct {
+		v    **variable
+		name string
+		eqn  string
+	}{
+		{&o.capacity, "capacity", xo.Capacity},
+		{&o.fillTime, "fill_time", xo.FillTime},
+		{&o.cookTime, "cook_time", xo.CookTime},
+	}
+	for _, opt := range options {
+		if opt.eqn == "" {
+			continue
+		}
+		var err error
+		if *opt.v, err = s.implicitAux(v, fmt.Sprintf("#%s.oven.%s", v.name, opt.name), opt.eqn); err != nil {
+			return err
+		}
+	}
+
+	for _, out := range v.outflows {
+		if out.oven != nil {
+			return fmt.Errorf("%s: '%s' already flows out of an oven", v.name, out.name)
+		}
+		out.oven = o
+		o.outflow = out
+	}
+	v.oven = o
+	s.ovens = append(s.ovens, o)
+	s.discrete = append(s.discrete, o)
+	return nil
+}
+
+// ovenOutflow is the outflow of an oven, which releases the oven's
+// contents in the time step after they have finished cooking.
+type ovenOutflow struct {
+	o *oven
+}
+
+func (e *ovenOutflow) eval(r *run) float64 {
+	b := &r.bakes[e.o.id]
+	if b.state != ovenUnloading {
+		return 0
+	}
+	return b.contents / r.dt
+}
+
+// start fills the oven with its initial value, if any.
+func (o *oven) start(r *run) {
+	b := &r.bakes[o.id]
+	*b = bake{contents: r.curr[o.stock.slot]}
+	if b.contents > 0 {
+		b.state = ovenFilling
+	}
+}
+
+// limitFlows reduces the inflows of the oven to what it can accept
+// this time step.  A filling oven takes what fits within its
+// capacity, and an oven that is cooking or unloading takes nothing.
+// Material can't flow backwards into an oven.
+func (o *oven) limitFlows(r *run) {
+	b := &r.bakes[o.id]
+	room := math.Inf(1)
+	if b.state == ovenCooking || b.state == ovenUnloading {
+		room = 0
+	} else if o.capacity != nil {
+		room = math.Max(r.curr[o.capacity.slot]-b.contents, 0)
+	}
+
+	inflows := o.stock.inflows
+	var total float64
+	for _, in := range inflows {
+		r.curr[in.slot] = math.Max(r.curr[in.slot], 0)
+		total += r.curr[in.slot] * r.dt
+	}
+	if o.interleaving && total > room {
+		// every inflow gets the same share of what it wanted
+		for _, in := range inflows {
+			r.curr[in.slot] *= room / total
+		}
+		return
+	}
+	for _, in := range inflows {
+		rate := r.curr[in.slot]
+		if rate*r.dt > room {
+			rate = room / r.dt
+		}
+		r.curr[in.slot] = rate
+		room -= rate * r.dt
+	}
+}
+
+// capture saves what the oven needs from the start of the time step,
+// as the Runge-Kutta methods recalculate flows part way through it.
+func (o *oven) capture(r *run) {
+	b := &r.bakes[o.id]
+	b.inflow = 0
+	for _, in := range o.stock.inflows {
+		b.inflow += r.curr[in.slot] * r.dt
+	}
+	b.capacity = math.Inf(1)
+	if o.capacity != nil {
+		b.capacity = r.curr[o.capacity.slot]
+	}
+	b.fillSteps = r.timeSteps(o.fillTime)
+	b.cookSteps = r.timeSteps(o.cookTime)
+}
+
+// update advances the oven's state machine by a time step.
+func (o *oven) update(r *run) {
+	b := &r.bakes[o.id]
+	switch b.state {
+	case ovenIdle, ovenFilling:
+		b.contents += b.inflow
+		if b.state == ovenIdle {
+			if b.contents <= 0 {
+				break
+			}
+			// the fill time starts when material first
+			// arrives.
+			b.state, b.steps = ovenFilling, 0
+		}
+		b.steps++
+		if b.steps >= b.fillSteps || b.contents >= b.capacity*(1-timeEpsilon) {
+			b.state, b.steps = ovenCooking, 0
+		}
+	case ovenCooking:
+		b.steps++
+		if b.steps >= b.cookSteps {
+			b.state = ovenUnloading
+		}
+	case ovenUnloading:
+		if o.outflow != nil {
+			b.contents, b.state = 0, ovenIdle
+		}
+	}
+	r.curr[o.stock.slot] = b.contents
+}
@@ -0,0 +1,116 @@
+// Copyright 2013 Bobby Powers. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package sim_test
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/bpowers/go-xmile/sim"
+	"github.com/bpowers/go-xmile/xmile"
+)
+
+func oven(name, eqn string, o *xmile.Oven, inflows, outflows []string) *xmile.Variable {
+	v := stock(name, eqn, inflows, outflows)
+	v.Oven = o
+	return v
+}
+
+func TestOvenCycles(t *testing.T) {
+	res := run(t, newFile(0, 13, 1,
+		oven("oven", "0", &xmile.Oven{Capacity: "100", FillTime: "2", CookTime: "3"},
+			[]string{"in"}, []string{"out"}),
+		flow("in", "10"),
+		flow("out", ""),
+	))
+	// fill for 2, cook for 3, unload, and start again
+	expectSeries(t, res, "oven", []float64{0, 10, 20, 20, 20, 20, 0, 10, 20, 20, 20, 20, 0, 10})
+	expectSeries(t, res, "in", []float64{10, 10, 0, 0, 0, 0, 10, 10, 0, 0, 0, 0, 10, 10})
+	expectSeries(t, res, "out", []float64{0, 0, 0, 0, 0, 20, 0, 0, 0, 0, 0, 20, 0, 0})
+}
+
+func TestOvenCapacity(t *testing.T) {
+	res := run(t, newFile(0, 9, 1,
+		oven("oven", "0", &xmile.Oven{Capacity: "25", FillTime: "5", CookTime: "1"},
+			[]string{"in"}, []string{"out"}),
+		flow("in", "IF TIME < 7 THEN 10 ELSE 0"),
+		flow("out", ""),
+	))
+	// reaching capacity ends filling early, and the fill time
+	// only starts when material arrives.
+	expectSeries(t, res, "oven", []float64{0, 10, 20, 25, 25, 0, 10, 20, 20, 20})
+	expectSeries(t, res, "in", []float64{10, 10, 5, 0, 0, 10, 10, 0, 0, 0})
+	expectSeries(t, res, "out", []float64{0, 0, 0, 0, 25, 0, 0, 0, 0, 0})
+}
+
+func TestOvenInterleaving(t *testing.T) {
+	o := &xmile.Oven{Capacity: "8", FillTime: "1", CookTime: "1"}
+	interleaved := *o
+	interleaved.Interleaving = new(xmile.Exister)
+	res := run(t, newFile(0, 3, 1,
+		oven("priority", "0", o, []string{"a1", "b1"}, []string{"out1"}),
+		flow("a1", "6"),
+		flow("b1", "6"),
+		flow("out1", ""),
+		oven("shared", "0", &interleaved, []string{"a2", "b2"}, []string{"out2"}),
+		flow("a2", "6"),
+		flow("b2", "6"),
+		flow("out2", ""),
+	))
+	// listed first, a1 is served first
+	expectSeries(t, res, "a1", []float64{6, 0, 0, 6})
+	expectSeries(t, res, "b1", []float64{2, 0, 0, 2})
+	// interleaved inflows share the room
+	expectSeries(t, res, "a2", []float64{4, 0, 0, 4})
+	expectSeries(t, res, "b2", []float64{4, 0, 0, 4})
+	expectSeries(t, res, "out2", []float64{0, 0, 8, 0})
+}
+
+func TestOvenRK4(t *testing.T) {
+	// ovens ignore the integration method
+	f := newFile(0, 13, 1,
+		oven("oven", "5", &xmile.Oven{FillTime: "2", CookTime: "3"},
+			[]string{"in"}, []string{"out"}),
+		flow("in", "10"),
+		flow("out", ""),
+		stock("done", "0", []string{"out"}, nil),
+	)
+	f.SimSpec.Method = "RK4"
+	res := run(t, f)
+	expectSeries(t, res, "oven", []float64{5, 15, 25, 25, 25, 25, 0, 10, 20, 20, 20, 20, 0, 10})
+	expectSeries(t, res, "done", []float64{0, 0, 0, 0, 0, 0, 25, 25, 25, 25, 25, 25, 45, 45})
+}
+
+func TestOvenErrors(t *testing.T) {
+	cases := []struct {
+		vars []*xmile.Variable
+		err  string
+	}{
+		{[]*xmile.Variable{
+			oven("o", "0", &xmile.Oven{CookTime: "1"}, nil, nil),
+		}, "oven without a fill_time"},
+		{[]*xmile.Variable{
+			oven("o", "0", &xmile.Oven{FillTime: "1"}, nil, nil),
+		}, "oven without a cook_time"},
+		{[]*xmile.Variable{
+			oven("o", "0", &xmile.Oven{FillTime: "1", CookTime: "1"}, nil, []string{"a", "b"}),
+			flow("a", ""),
+			flow("b", ""),
+		}, "ovens can only have one outflow"},
+		{[]*xmile.Variable{
+			func() *xmile.Variable {
+				v := oven("o", "0", &xmile.Oven{FillTime: "1", CookTime: "1"}, nil, nil)
+				v.Queue = new(xmile.Exister)
+				return v
+			}(),
+		}, "can only be one of a conveyor, queue or oven"},
+	}
+	for _, c := range cases {
+		_, err := sim.New(newFile(0, 1, 1, c.vars...))
+		if err == nil || !strings.Contains(err.Error(), c.err) {
+			t.Errorf("expected error containing '%s', got %v", c.err, err)
+		}
+	}
+}
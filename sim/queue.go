@@ -0,0 +1,153 @@
+// Copyright 2013 Bobby Powers. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package sim
+
+import (
+	"fmt"
+	"math"
+)
+
+// queue is a stock whose contents leave in the order they arrived.
+// What flows in through each inflow in a time step joins the back of
+// the queue as a batch, and batches leave from the front.  Outflows
+// are served in the order they are listed: each takes whole batches
+// from the front of the queue while the next batch fits within its
+// rate, and the next outflow starts where it stopped.  An outflow
+// that can't take the whole of the front batch takes part of it, so
+// that big batches don't block the queue.  An overflow
+// outflow takes whatever the other outflows couldn't, so nothing
+// waits in the queue.  Queues are updated once per time step,
+// regardless of the integration method.
+type queue struct {
+	id       int // index into run.lines
+	stock    *variable
+	outflows []*variable // in priority order, without overflows
+	overflow *variable   // nil if the queue doesn't overflow
+}
+
+// line is the state of a queue during a run.
+type line struct {
+	batches []float64 // oldest first
+	// the amount that entered through each inflow and the amount
+	// that left over the current time step.
+	arrivals []float64
+	left     float64
+}
+
+func (s *Sim) compileQueue(v *variable) error {
+	q := &queue{id: len(s.queues), stock: v}
+	for _, out := range v.outflows {
+		if out.queue != nil {
+			return fmt.Errorf("%s: '%s' already flows out of a queue", v.name, out.name)
+		}
+		out.queue = q
+		if !out.overflow {
+			q.outflows = append(q.outflows, out)
+		} else if q.overflow == nil {
+			q.overflow = out
+		} else {
+			return fmt.Errorf("%s: queues can only have one overflow", v.name)
+		}
+	}
+	v.queue = q
+	s.queues = append(s.queues, q)
+	s.discrete = append(s.discrete, q)
+	return nil
+}
+
+// newLine returns the state of an empty queue.
+func (q *queue) newLine() line {
+	return line{arrivals: make([]float64, len(q.stock.inflows))}
+}
+
+// start puts the queue's initial value in a single batch.
+func (q *queue) start(r *run) {
+	l := &r.lines[q.id]
+	l.batches = l.batches[:0]
+	if initial := r.curr[q.stock.slot]; initial > 0 {
+		l.batches = append(l.batches, initial)
+	}
+}
+
+// limitFlows sets the outflows of the queue from the batches at its
+// front, with each outflow's equation giving the most it can take.
+// Material can't flow backwards into a queue.
+func (q *queue) limitFlows(r *run) {
+	for _, in := range q.stock.inflows {
+		r.curr[in.slot] = math.Max(r.curr[in.slot], 0)
+	}
+
+	batches := r.lines[q.id].batches
+	// the next batch, and how much of it has been taken already
+	next, taken := 0, 0.0
+	for _, out := range q.outflows {
+		room := math.Max(r.curr[out.slot], 0) * r.dt
+		var took float64
+		for next < len(batches) {
+			amount := batches[next] - taken
+			if amount <= room*(1+timeEpsilon) {
+				took += amount
+				room -= amount
+				next, taken = next+1, 0
+				continue
+			}
+			if took == 0 {
+				// no whole batch fits, so the outflow takes
+				// what it can of the front one.
+				took = room
+				taken += room
+			}
+			break
+		}
+		r.curr[out.slot] = took / r.dt
+	}
+
+	if q.overflow != nil {
+		rest := -taken
+		for _, amount := range batches[next:] {
+			rest += amount
+		}
+		r.curr[q.overflow.slot] = math.Max(rest, 0) / r.dt
+	}
+}
+
+// capture saves the queue's flows at the start of the time step, as
+// the Runge-Kutta methods recalculate flows part way through it.
+func (q *queue) capture(r *run) {
+	l := &r.lines[q.id]
+	for i, in := range q.stock.inflows {
+		l.arrivals[i] = r.curr[in.slot] * r.dt
+	}
+	l.left = 0
+	for _, out := range q.stock.outflows {
+		l.left += r.curr[out.slot] * r.dt
+	}
+}
+
+// update removes what left from the front of the queue, and adds the
+// arrivals to the back.  Outflows reduced by the stocks they flow
+// into leave the rest of their batches at the front of the queue.
+func (q *queue) update(r *run) {
+	l := &r.lines[q.id]
+	left := l.left
+	for len(l.batches) > 0 && left > 0 {
+		if l.batches[0] > left*(1+timeEpsilon) {
+			l.batches[0] -= left
+			break
+		}
+		left -= l.batches[0]
+		l.batches = l.batches[1:]
+	}
+	for _, amount := range l.arrivals {
+		if amount > 0 {
+			l.batches = append(l.batches, amount)
+		}
+	}
+	var total float64
+	for _, amount := range l.batches {
+		total += amount
+	}
+	r.curr[q.stock.slot] = total
+}
@@ -0,0 +1,127 @@
+// Copyright 2013 Bobby Powers. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package sim_test
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/bpowers/go-xmile/sim"
+	"github.com/bpowers/go-xmile/xmile"
+)
+
+func queue(name, eqn string, inflows, outflows []string) *xmile.Variable {
+	v := stock(name, eqn, inflows, outflows)
+	v.Queue = new(xmile.Exister)
+	return v
+}
+
+func overflow(name string) *xmile.Variable {
+	v := flow(name, "")
+	v.Overflow = new(xmile.Exister)
+	return v
+}
+
+func TestQueue(t *testing.T) {
+	res := run(t, newFile(0, 5, 1,
+		queue("q", "0", []string{"in"}, []string{"first", "second"}),
+		flow("in", "IF TIME = 0 THEN 5 ELSE IF TIME = 1 THEN 8 ELSE IF TIME = 2 THEN 2 ELSE 0"),
+		flow("first", "6"),
+		flow("second", "10"),
+	))
+	expectSeries(t, res, "q", []float64{0, 5, 8, 2, 0, 0})
+	// the batch of 8 is too big for first, which takes what it
+	// can, and second takes the rest.
+	expectSeries(t, res, "first", []float64{0, 5, 6, 2, 0, 0})
+	expectSeries(t, res, "second", []float64{0, 0, 2, 0, 0, 0})
+}
+
+func TestQueueDrains(t *testing.T) {
+	// the initial batch is too big for the outflow, which takes
+	// part of it each step until the batches behind it fit.
+	res := run(t, newFile(0, 3, 1,
+		queue("q", "10", []string{"in"}, []string{"out"}),
+		flow("in", "1"),
+		flow("out", "4"),
+	))
+	expectSeries(t, res, "q", []float64{10, 7, 4, 1})
+	expectSeries(t, res, "out", []float64{4, 4, 4, 1})
+
+	res = run(t, newFile(0, 10, 1,
+		queue("q", "100", nil, []string{"out"}),
+		flow("out", "10"),
+	))
+	expectSeries(t, res, "q", []float64{100, 90, 80, 70, 60, 50, 40, 30, 20, 10, 0})
+}
+
+func TestQueueBatches(t *testing.T) {
+	res := run(t, newFile(0, 3, 1,
+		queue("q", "0", []string{"a", "b"}, []string{"out"}),
+		flow("a", "PULSE(3, 0)"),
+		flow("b", "PULSE(5, 0)"),
+		flow("out", "6"),
+	))
+	// each inflow's batch leaves whole, in order
+	expectSeries(t, res, "q", []float64{0, 8, 5, 0})
+	expectSeries(t, res, "out", []float64{0, 3, 5, 0})
+}
+
+func TestQueueOverflow(t *testing.T) {
+	res := run(t, newFile(0, 3, 1,
+		queue("q", "0", []string{"a", "b"}, []string{"out", "spill"}),
+		flow("a", "PULSE(2, 0)"),
+		flow("b", "PULSE(5, 0)"),
+		flow("out", "3"),
+		overflow("spill"),
+	))
+	expectSeries(t, res, "q", []float64{0, 7, 0, 0})
+	// the batch of 5 is too big for what's left of out, so it
+	// overflows whole.
+	expectSeries(t, res, "out", []float64{0, 2, 0, 0})
+	expectSeries(t, res, "spill", []float64{0, 5, 0, 0})
+}
+
+func TestQueueIntoConveyor(t *testing.T) {
+	// what the conveyor can't accept waits at the front of the
+	// queue.
+	res := run(t, newFile(0, 5, 1,
+		queue("q", "4", nil, []string{"load"}),
+		flow("load", ""),
+		conveyor("belt", "0", &xmile.Conveyor{Len: "10", InLimit: "1"}, []string{"load"}, nil),
+	))
+	expectSeries(t, res, "q", []float64{4, 3, 2, 1, 0, 0})
+	expectSeries(t, res, "load", []float64{1, 1, 1, 1, 0, 0})
+	expectSeries(t, res, "belt", []float64{0, 1, 2, 3, 4, 4})
+}
+
+func TestQueueErrors(t *testing.T) {
+	cases := []struct {
+		vars []*xmile.Variable
+		err  string
+	}{
+		{[]*xmile.Variable{
+			func() *xmile.Variable {
+				v := aux("x", "1")
+				v.Queue = new(xmile.Exister)
+				return v
+			}(),
+		}, "only stocks can be queues"},
+		{[]*xmile.Variable{
+			stock("s", "1", nil, []string{"out"}),
+			overflow("out"),
+		}, "only flows out of a queue can overflow"},
+		{[]*xmile.Variable{
+			queue("q", "1", nil, []string{"a", "b"}),
+			overflow("a"),
+			overflow("b"),
+		}, "queues can only have one overflow"},
+	}
+	for _, c := range cases {
+		_, err := sim.New(newFile(0, 1, 1, c.vars...))
+		if err == nil || !strings.Contains(err.Error(), c.err) {
+			t.Errorf("expected error containing '%s', got %v", c.err, err)
+		}
+	}
+}
@@ -0,0 +1,190 @@
+// Copyright 2013 Bobby Powers. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package sim
+
+import (
+	"fmt"
+	"hash/fnv"
+	"math"
+	"math/rand/v2"
+
+	"github.com/bpowers/go-xmile/smile"
+)
+
+// random is a call to a random number builtin.  Each call draws from
+// a stream of its own, seeded from the run's seed and the call's
+// name, so adding a random call to one variable doesn't change the
+// numbers drawn by another.  A call with a seed argument instead
+// draws the same numbers in every run.
+type random struct {
+	id     int    // index into run.streams
+	name   string // identifies the call within the model
+	seed   uint64
+	seeded bool // if the call has its own seed
+	dist   func(rng *rand.Rand, args []float64) float64
+	args   []expr
+}
+
+// stream is the state of a random call during a run.  A number is
+// drawn once per time step, so the intermediate steps of the
+// Runge-Kutta methods all see the same value.
+type stream struct {
+	rng   *rand.Rand
+	step  int // the time step value was drawn for
+	value float64
+	args  []float64 // scratch space for the call's arguments
+}
+
+// randomBuiltin returns a compile function for a random builtin
+// drawing from dist, whose last argument, after the distribution's
+// nargs parameters, is an optional seed.
+func randomBuiltin(nargs int, dist func(*rand.Rand, []float64) float64) func(*compiler, []smile.Expr) (expr, error) {
+	return func(c *compiler, args []smile.Expr) (expr, error) {
+		s := c.s
+		x := &random{
+			id:   len(s.randoms),
+			name: fmt.Sprintf("#%s.random#%d", c.v.name, c.v.instances),
+			dist: dist,
+		}
+		c.v.instances++
+		for _, a := range args[:nargs] {
+			arg, err := c.compile(a)
+			if err != nil {
+				return nil, err
+			}
+			x.args = append(x.args, arg)
+		}
+		if len(args) > nargs {
+			seed, ok := constValue(args[nargs])
+			if !ok {
+				return nil, fmt.Errorf("the seed of a random builtin must be a constant")
+			}
+			x.seed, x.seeded = uint64(int64(seed)), true
+		}
+		s.randoms = append(s.randoms, x)
+		return x, nil
+	}
+}
+
+// newStream starts the call's stream of random numbers for a run
+// with the given seed.
+func (x *random) newStream(seed int64) stream {
+	h := fnv.New64a()
+	h.Write([]byte(x.name))
+	if x.seeded {
+		seed = int64(x.seed)
+	}
+	return stream{
+		rng:  rand.New(rand.NewPCG(uint64(seed), h.Sum64())),
+		step: -1,
+		args: make([]float64, len(x.args)),
+	}
+}
+
+func (x *random) eval(r *run) float64 {
+	st := &r.streams[x.id]
+	if st.step != r.step {
+		for i, a := range x.args {
+			st.args[i] = a.eval(r)
+		}
+		st.value = x.dist(st.rng, st.args)
+		st.step = r.step
+	}
+	return st.value
+}
+
+func uniform(rng *rand.Rand, args []float64) float64 {
+	min, max := args[0], args[1]
+	return min + (max-min)*rng.Float64()
+}
+
+func normal(rng *rand.Rand, args []float64) float64 {
+	mean, sd := args[0], args[1]
+	return mean + sd*rng.NormFloat64()
+}
+
+// lognormal draws from the lognormal distribution with the given
+// mean and standard deviation, which are those of the distribution
+// itself rather than of its logarithm.
+func lognormal(rng *rand.Rand, args []float64) float64 {
+	mean, sd := args[0], args[1]
+	if mean <= 0 {
+		return math.NaN()
+	}
+	v := math.Log1p(sd * sd / (mean * mean))
+	mu := math.Log(mean) - v/2
+	return math.Exp(mu + math.Sqrt(v)*rng.NormFloat64())
+}
+
+func exprnd(rng *rand.Rand, args []float64) float64 {
+	return args[0] * rng.ExpFloat64()
+}
+
+// poisson draws from the Poisson distribution with the given mean,
+// multiplying uniform numbers together for small means and with
+// Hörmann's transformed rejection method for large ones.
+func poisson(rng *rand.Rand, args []float64) float64 {
+	mean := args[0]
+	switch {
+	case mean < 0 || math.IsNaN(mean):
+		return math.NaN()
+	case mean == 0:
+		return 0
+	case mean < 10:
+		limit := math.Exp(-mean)
+		p := rng.Float64()
+		var k float64
+		for p > limit {
+			p *= rng.Float64()
+			k++
+		}
+		return k
+	}
+
+	smu := math.Sqrt(mean)
+	b := 0.931 + 2.53*smu
+	a := -0.059 + 0.02483*b
+	invAlpha := 1.1239 + 1.1328/(b-3.4)
+	vr := 0.9277 - 3.6224/(b-2)
+	logMean := math.Log(mean)
+	for {
+		u := rng.Float64() - 0.5
+		v := rng.Float64()
+		us := 0.5 - math.Abs(u)
+		k := math.Floor((2*a/us+b)*u + mean + 0.43)
+		if us >= 0.07 && v <= vr {
+			return k
+		} else if k < 0 || (us < 0.013 && v > us) {
+			continue
+		}
+		lg, _ := math.Lgamma(k + 1)
+		if math.Log(v)+math.Log(invAlpha)-math.Log(a/(us*us)+b) <= -mean+k*logMean-lg {
+			return k
+		}
+	}
+}
+
+func init() {
+	for _, b := range []struct {
+		name  string
+		nargs int
+		dist  func(*rand.Rand, []float64) float64
+	}{
+		{"EXPRND", 1, exprnd},
+		{"LOGNORMAL", 2, lognormal},
+		{"NORMAL", 2, normal},
+		{"POISSON", 1, poisson},
+		// RANDOM is isee's name for UNIFORM.
+		{"RANDOM", 2, uniform},
+		{"UNIFORM", 2, uniform},
+	} {
+		register(&Builtin{
+			Name:    b.name,
+			MinArgs: b.nargs,
+			MaxArgs: b.nargs + 1,
+			compile: randomBuiltin(b.nargs, b.dist),
+		})
+	}
+}
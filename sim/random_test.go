@@ -0,0 +1,141 @@
+// Copyright 2013 Bobby Powers. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package sim_test
+
+import (
+	"math"
+	"strings"
+	"testing"
+
+	"github.com/bpowers/go-xmile/sim"
+	"github.com/bpowers/go-xmile/xmile"
+)
+
+func runSeed(t *testing.T, f *xmile.File, seed int64) *sim.Results {
+	s, err := sim.New(f)
+	if err != nil {
+		t.Fatalf("sim.New: %s", err)
+	}
+	res, err := s.RunWith(sim.Options{Seed: seed})
+	if err != nil {
+		t.Fatalf("Run: %s", err)
+	}
+	return res
+}
+
+func sameSeries(a, b []float64) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if math.Float64bits(a[i]) != math.Float64bits(b[i]) {
+			return false
+		}
+	}
+	return true
+}
+
+func TestRandomSeeds(t *testing.T) {
+	f := newFile(0, 50, 1,
+		aux("a", "NORMAL(0, 1)"),
+		aux("b", "normal(0, 1)"),
+		aux("fixed", "UNIFORM(0, 1, 42)"),
+		stock("s", "0", []string{"in"}, nil),
+		flow("in", "POISSON(3)"),
+	)
+	first, again, other := runSeed(t, f, 1), runSeed(t, f, 1), runSeed(t, f, 2)
+	for name, series := range first.Values {
+		if !sameSeries(series, again.Values[name]) {
+			t.Errorf("%s: runs with the same seed differ", name)
+		}
+	}
+	for _, name := range []string{"a", "b", "s"} {
+		if sameSeries(first.Values[name], other.Values[name]) {
+			t.Errorf("%s: runs with different seeds are the same", name)
+		}
+	}
+	if sameSeries(first.Values["a"], first.Values["b"]) {
+		t.Errorf("variables share a random stream")
+	}
+	// a seed argument fixes the stream whatever the run's seed
+	if !sameSeries(first.Values["fixed"], other.Values["fixed"]) {
+		t.Errorf("a call with a seed argument differs between runs")
+	}
+}
+
+func TestRandomIntegration(t *testing.T) {
+	// numbers are drawn once per time step, so the Runge-Kutta
+	// methods see the same flow as Euler's method.
+	var results [2]*sim.Results
+	for i, method := range []string{"Euler", "RK4"} {
+		f := newFile(0, 10, .5,
+			stock("s", "0", []string{"in"}, nil),
+			flow("in", "UNIFORM(0, 10)"),
+		)
+		f.SimSpec.Method = method
+		results[i] = runSeed(t, f, 7)
+	}
+	euler, _ := results[0].Lookup("s")
+	rk4, _ := results[1].Lookup("s")
+	for i := range euler {
+		if math.Abs(euler[i]-rk4[i]) > 1e-9 {
+			t.Fatalf("expected the same stock with Euler and RK4, got %v and %v", euler, rk4)
+		}
+	}
+}
+
+func TestRandomDistributions(t *testing.T) {
+	cases := []struct {
+		eqn      string
+		mean, sd float64
+		integer  bool
+	}{
+		{"UNIFORM(2, 8)", 5, math.Sqrt(3), false},
+		{"RANDOM(2, 8)", 5, math.Sqrt(3), false},
+		{"NORMAL(10, 2)", 10, 2, false},
+		{"LOGNORMAL(5, 1)", 5, 1, false},
+		{"EXPRND(3)", 3, 3, false},
+		{"POISSON(4)", 4, 2, true},
+		{"POISSON(100)", 100, 10, true},
+	}
+	const n = 20000
+	for _, c := range cases {
+		res := runSeed(t, newFile(0, n-1, 1, aux("x", c.eqn)), 1)
+		series, _ := res.Lookup("x")
+		var sum, sumSq float64
+		for _, x := range series {
+			if c.integer && x != math.Floor(x) {
+				t.Fatalf("%s: expected integers, got %g", c.eqn, x)
+			}
+			sum += x
+			sumSq += x * x
+		}
+		mean := sum / n
+		sd := math.Sqrt(sumSq/n - mean*mean)
+		if math.Abs(mean-c.mean) > 4*c.sd/math.Sqrt(n) {
+			t.Errorf("%s: expected a mean of %g, got %g", c.eqn, c.mean, mean)
+		}
+		if math.Abs(sd-c.sd) > .05*c.sd {
+			t.Errorf("%s: expected a standard deviation of %g, got %g", c.eqn, c.sd, sd)
+		}
+	}
+}
+
+func TestRandomErrors(t *testing.T) {
+	cases := []struct {
+		eqn string
+		err string
+	}{
+		{"NORMAL(1)", "NORMAL takes at least 2 arguments, not 1"},
+		{"POISSON(1, 2, 3)", "POISSON takes at most 2 arguments, not 3"},
+		{"UNIFORM(0, 1, TIME)", "the seed of a random builtin must be a constant"},
+	}
+	for _, c := range cases {
+		_, err := sim.New(newFile(0, 1, 1, aux("x", c.eqn)))
+		if err == nil || !strings.Contains(err.Error(), c.err) {
+			t.Errorf("%s: expected error containing '%s', got %v", c.eqn, c.err, err)
+		}
+	}
+}
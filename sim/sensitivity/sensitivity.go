@@ -0,0 +1,296 @@
+// Copyright 2013 Bobby Powers. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Package sensitivity runs a model many times, with its constants
+// drawn from distributions, and summarizes how its variables vary
+// across the runs as percentile bands.
+package sensitivity
+
+import (
+	"fmt"
+	"math"
+	"math/rand/v2"
+	"runtime"
+	"sort"
+	"sync"
+
+	"github.com/bpowers/go-xmile/sim"
+)
+
+// Distribution is a probability distribution a constant's values are
+// drawn from.
+type Distribution interface {
+	// Quantile returns the value below which a fraction p of the
+	// distribution lies.
+	Quantile(p float64) float64
+}
+
+// Uniform is the uniform distribution between Min and Max.
+type Uniform struct {
+	Min, Max float64
+}
+
+func (d Uniform) Quantile(p float64) float64 {
+	return d.Min + p*(d.Max-d.Min)
+}
+
+// Normal is the normal distribution with the given mean and standard
+// deviation.
+type Normal struct {
+	Mean, SD float64
+}
+
+func (d Normal) Quantile(p float64) float64 {
+	return d.Mean + d.SD*math.Sqrt2*math.Erfinv(2*p-1)
+}
+
+// Triangular is the triangular distribution between Min and Max,
+// peaking at Mode.
+type Triangular struct {
+	Min, Mode, Max float64
+}
+
+func (d Triangular) Quantile(p float64) float64 {
+	width := d.Max - d.Min
+	if width <= 0 {
+		return d.Min
+	}
+	if p < (d.Mode-d.Min)/width {
+		return d.Min + math.Sqrt(p*width*(d.Mode-d.Min))
+	}
+	return d.Max - math.Sqrt((1-p)*width*(d.Max-d.Mode))
+}
+
+// Sampling is a way of drawing values from the distributions of the
+// parameters.
+type Sampling int
+
+const (
+	// Random draws each value independently.
+	Random Sampling = iota
+	// LatinHypercube divides each distribution into as many
+	// equally likely intervals as there are runs, and draws
+	// once from each interval, in a random order.  It covers
+	// the distributions more evenly than Random for the same
+	// number of runs.
+	LatinHypercube
+)
+
+func (s Sampling) String() string {
+	switch s {
+	case Random:
+		return "random"
+	case LatinHypercube:
+		return "latin hypercube"
+	default:
+		return "unknown"
+	}
+}
+
+// Param is a constant of the model, which is given a value drawn from
+// Dist in each run.
+type Param struct {
+	Name string
+	Dist Distribution
+}
+
+// Config describes a set of runs.
+type Config struct {
+	Params   []Param
+	Runs     int
+	Sampling Sampling
+	// Seed seeds the sampling of the parameters and, through
+	// sim.Options, the random builtins of each run.
+	Seed int64
+	// Outputs are the variables to summarize.  If empty, every
+	// variable is.
+	Outputs []string
+	// Percentiles are the percentiles of each band, between 0
+	// and 100.  If empty, DefaultPercentiles are used.
+	Percentiles []float64
+	// Workers is the number of runs made at once.  If zero,
+	// runtime.GOMAXPROCS(0) is used.
+	Workers int
+}
+
+// DefaultPercentiles are the percentiles used if a Config doesn't
+// give any: the median and the bounds of the central 50% and 90% of
+// runs.
+var DefaultPercentiles = []float64{5, 25, 50, 75, 95}
+
+// Results contains the percentile bands of every output over a set
+// of runs.
+type Results struct {
+	Time        []float64
+	Percentiles []float64
+	// Bands holds the values of each output at each percentile,
+	// keyed by canonical variable name and indexed by percentile
+	// and then by saved time step.
+	Bands map[string][][]float64
+	// Samples holds the value of each Param in each run.
+	Samples [][]float64
+}
+
+// Lookup returns the bands of the named variable.  The name does not
+// need to be in canonical form.
+func (r *Results) Lookup(name string) ([][]float64, bool) {
+	bands, ok := r.Bands[sim.CanonicalName(name)]
+	return bands, ok
+}
+
+// Run runs s c.Runs times, concurrently, with the constants in
+// c.Params set to values drawn from their distributions.  The results
+// are the same whatever the number of workers.
+func Run(s *sim.Sim, c Config) (*Results, error) {
+	if c.Runs <= 0 {
+		return nil, fmt.Errorf("the number of runs must be positive, not %d", c.Runs)
+	} else if c.Sampling != Random && c.Sampling != LatinHypercube {
+		return nil, fmt.Errorf("unknown sampling method %d", c.Sampling)
+	}
+	percentiles := c.Percentiles
+	if len(percentiles) == 0 {
+		percentiles = DefaultPercentiles
+	}
+	for _, p := range percentiles {
+		if !(p >= 0 && p <= 100) {
+			return nil, fmt.Errorf("percentile %g isn't between 0 and 100", p)
+		}
+	}
+	for _, p := range c.Params {
+		if p.Dist == nil {
+			return nil, fmt.Errorf("%s: missing distribution", p.Name)
+		}
+	}
+	workers := c.Workers
+	if workers <= 0 {
+		workers = runtime.GOMAXPROCS(0)
+	}
+
+	rng := rand.New(rand.NewPCG(uint64(c.Seed), 0))
+	samples := sample(c.Params, c.Runs, c.Sampling, rng)
+	// each run's random builtins are seeded from the same stream
+	// as the samples, so that configs with nearby seeds don't
+	// share runs.
+	seeds := make([]int64, c.Runs)
+	for i := range seeds {
+		seeds[i] = rng.Int64()
+	}
+	runs := make([]*sim.Results, c.Runs)
+	errs := make([]error, c.Runs)
+	next := make(chan int)
+	var wg sync.WaitGroup
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range next {
+				opts := sim.Options{
+					Seed:      seeds[i],
+					Constants: make(map[string]float64, len(c.Params)),
+				}
+				for j, p := range c.Params {
+					opts.Constants[p.Name] = samples[i][j]
+				}
+				runs[i], errs[i] = s.RunWith(opts)
+				if errs[i] == nil {
+					runs[i] = outputs(runs[i], c.Outputs)
+				}
+			}
+		}()
+	}
+	for i := 0; i < c.Runs; i++ {
+		next <- i
+	}
+	close(next)
+	wg.Wait()
+	for i, err := range errs {
+		if err != nil {
+			return nil, fmt.Errorf("run %d: %s", i, err)
+		}
+	}
+	for _, name := range c.Outputs {
+		if _, ok := runs[0].Lookup(name); !ok {
+			return nil, fmt.Errorf("unknown output '%s'", name)
+		}
+	}
+
+	res := &Results{
+		Time:        runs[0].Time,
+		Percentiles: percentiles,
+		Bands:       make(map[string][][]float64, len(runs[0].Values)),
+		Samples:     samples,
+	}
+	values := make([]float64, c.Runs)
+	for name := range runs[0].Values {
+		bands := make([][]float64, len(percentiles))
+		for i := range bands {
+			bands[i] = make([]float64, len(res.Time))
+		}
+		for t := range res.Time {
+			for i, r := range runs {
+				values[i] = r.Values[name][t]
+			}
+			sort.Float64s(values)
+			for i, p := range percentiles {
+				bands[i][t] = percentile(values, p)
+			}
+		}
+		res.Bands[name] = bands
+	}
+	return res, nil
+}
+
+// sample draws n values for each of params, returning the values of
+// each run.
+func sample(params []Param, n int, sampling Sampling, rng *rand.Rand) [][]float64 {
+	samples := make([][]float64, n)
+	for i := range samples {
+		samples[i] = make([]float64, len(params))
+	}
+	for j, p := range params {
+		var perm []int
+		if sampling == LatinHypercube {
+			perm = rng.Perm(n)
+		}
+		for i := range samples {
+			q := rng.Float64()
+			for q == 0 {
+				// the quantile of 0 may be infinite.
+				q = rng.Float64()
+			}
+			if perm != nil {
+				q = (float64(perm[i]) + q) / float64(n)
+			}
+			samples[i][j] = p.Dist.Quantile(q)
+		}
+	}
+	return samples
+}
+
+// outputs returns res with only the named variables, or res itself if
+// names is empty, so that the results of many runs can be kept.
+func outputs(res *sim.Results, names []string) *sim.Results {
+	if len(names) == 0 {
+		return res
+	}
+	kept := &sim.Results{Time: res.Time, Values: make(map[string][]float64, len(names))}
+	for _, name := range names {
+		if series, ok := res.Lookup(name); ok {
+			kept.Values[sim.CanonicalName(name)] = series
+		}
+	}
+	return kept
+}
+
+// percentile returns the p'th percentile of sorted values,
+// interpolating linearly between neighbouring values.
+func percentile(sorted []float64, p float64) float64 {
+	pos := p / 100 * float64(len(sorted)-1)
+	i := int(math.Floor(pos))
+	if i >= len(sorted)-1 {
+		return sorted[len(sorted)-1]
+	}
+	frac := pos - float64(i)
+	return sorted[i] + frac*(sorted[i+1]-sorted[i])
+}
@@ -0,0 +1,211 @@
+// Copyright 2013 Bobby Powers. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package sensitivity_test
+
+import (
+	"encoding/xml"
+	"math"
+	"sort"
+	"strings"
+	"testing"
+
+	"github.com/bpowers/go-xmile/sim"
+	"github.com/bpowers/go-xmile/sim/sensitivity"
+	"github.com/bpowers/go-xmile/xmile"
+)
+
+func variable(kind, name, eqn string) *xmile.Variable {
+	return &xmile.Variable{XMLName: xml.Name{Local: kind}, Name: name, Eqn: eqn}
+}
+
+// growth returns a model of a population growing at a constant rate,
+// with some noise.
+func growth(t *testing.T) *sim.Sim {
+	pop := variable("stock", "pop", "100")
+	pop.Inflows = []string{"births"}
+	f := xmile.NewFile(1, "test")
+	f.SimSpec = xmile.SimSpec{Start: 0, Stop: 10, DT: 1}
+	f.Models = append(f.Models, &xmile.Model{Variables: []*xmile.Variable{
+		pop,
+		variable("flow", "births", "pop * rate"),
+		variable("aux", "rate", ".1"),
+		variable("aux", "noise", "NORMAL(0, 1)"),
+	}})
+	s, err := sim.New(f)
+	if err != nil {
+		t.Fatalf("sim.New: %s", err)
+	}
+	return s
+}
+
+func TestRun(t *testing.T) {
+	s := growth(t)
+	config := sensitivity.Config{
+		Params:   []sensitivity.Param{{Name: "rate", Dist: sensitivity.Uniform{Min: 0, Max: .2}}},
+		Runs:     200,
+		Sampling: sensitivity.LatinHypercube,
+		Seed:     1,
+		Workers:  4,
+	}
+	res, err := sensitivity.Run(s, config)
+	if err != nil {
+		t.Fatalf("Run: %s", err)
+	}
+	if len(res.Time) != 11 || len(res.Percentiles) != len(sensitivity.DefaultPercentiles) {
+		t.Fatalf("expected 11 times and the default percentiles, got %v and %v", res.Time, res.Percentiles)
+	}
+	bands, ok := res.Lookup("Pop")
+	if !ok {
+		t.Fatalf("no bands for 'pop'")
+	}
+	for i := range bands {
+		if bands[i][0] != 100 {
+			t.Errorf("expected every run to start at 100, got %g", bands[i][0])
+		}
+	}
+	for i := 1; i < len(bands); i++ {
+		for j := range res.Time {
+			if bands[i][j] < bands[i-1][j] {
+				t.Fatalf("percentiles out of order at t=%g", res.Time[j])
+			}
+		}
+	}
+	// the median rate is .1
+	median, expected := bands[2][10], 100*math.Pow(1.1, 10)
+	if math.Abs(median-expected) > .02*expected {
+		t.Errorf("expected a median of about %g, got %g", expected, median)
+	}
+	if bands[0][10] >= median || bands[4][10] <= median {
+		t.Errorf("expected the bands to spread out, got %g, %g, %g", bands[0][10], median, bands[4][10])
+	}
+
+	// latin hypercube sampling draws once from each interval
+	rates := make([]float64, len(res.Samples))
+	for i, sample := range res.Samples {
+		rates[i] = sample[0]
+	}
+	sort.Float64s(rates)
+	for i, r := range rates {
+		if r < .2*float64(i)/200 || r >= .2*float64(i+1)/200 {
+			t.Fatalf("sample %d (%g) isn't in its interval", i, r)
+		}
+	}
+
+	// the results don't depend on the number of workers
+	config.Workers = 1
+	again, err := sensitivity.Run(s, config)
+	if err != nil {
+		t.Fatalf("Run: %s", err)
+	}
+	for name, bands := range res.Bands {
+		for i := range bands {
+			for j := range bands[i] {
+				if again.Bands[name][i][j] != bands[i][j] {
+					t.Fatalf("%s: results differ with 1 worker", name)
+				}
+			}
+		}
+	}
+}
+
+func TestOutputs(t *testing.T) {
+	res, err := sensitivity.Run(growth(t), sensitivity.Config{
+		Params: []sensitivity.Param{
+			{Name: "rate", Dist: sensitivity.Normal{Mean: .1, SD: .01}},
+			{Name: "pop", Dist: sensitivity.Triangular{Min: 50, Mode: 100, Max: 200}},
+		},
+		Runs:        20,
+		Outputs:     []string{"Pop"},
+		Percentiles: []float64{0, 100},
+	})
+	if err != nil {
+		t.Fatalf("Run: %s", err)
+	}
+	if len(res.Bands) != 1 {
+		t.Errorf("expected only the bands of pop, got %d", len(res.Bands))
+	}
+	bands, _ := res.Lookup("pop")
+	min, max := math.Inf(1), math.Inf(-1)
+	for _, sample := range res.Samples {
+		min, max = math.Min(min, sample[1]), math.Max(max, sample[1])
+	}
+	if bands[0][0] != min || bands[1][0] != max {
+		t.Errorf("expected the initial pop to range from %g to %g, got %g to %g",
+			min, max, bands[0][0], bands[1][0])
+	}
+}
+
+func TestSeeds(t *testing.T) {
+	// studies with adjacent seeds share none of their random
+	// numbers.
+	s := growth(t)
+	seen := make(map[float64]int64)
+	for _, seed := range []int64{1, 2} {
+		res, err := sensitivity.Run(s, sensitivity.Config{
+			Runs:        2,
+			Seed:        seed,
+			Outputs:     []string{"noise"},
+			Percentiles: []float64{0, 100},
+		})
+		if err != nil {
+			t.Fatalf("Run: %s", err)
+		}
+		bands, _ := res.Lookup("noise")
+		for _, band := range bands {
+			for _, x := range band {
+				if other, ok := seen[x]; ok && other != seed {
+					t.Fatalf("seeds %d and %d both drew %g", other, seed, x)
+				}
+				seen[x] = seed
+			}
+		}
+	}
+}
+
+func TestQuantiles(t *testing.T) {
+	cases := []struct {
+		dist     sensitivity.Distribution
+		p        float64
+		expected float64
+	}{
+		{sensitivity.Uniform{Min: 2, Max: 4}, .25, 2.5},
+		{sensitivity.Normal{Mean: 5, SD: 2}, .5, 5},
+		{sensitivity.Normal{Mean: 0, SD: 1}, .975, 1.959963984540054},
+		{sensitivity.Triangular{Min: 0, Mode: 1, Max: 2}, .5, 1},
+		{sensitivity.Triangular{Min: 0, Mode: 1, Max: 2}, .125, .5},
+		{sensitivity.Triangular{Min: 0, Mode: 0, Max: 1}, .75, .5},
+	}
+	for _, c := range cases {
+		if q := c.dist.Quantile(c.p); math.Abs(q-c.expected) > 1e-9 {
+			t.Errorf("%+v: expected quantile %g to be %g, got %g", c.dist, c.p, c.expected, q)
+		}
+	}
+}
+
+func TestErrors(t *testing.T) {
+	uniform := sensitivity.Uniform{Min: 0, Max: 1}
+	cases := []struct {
+		config sensitivity.Config
+		err    string
+	}{
+		{sensitivity.Config{}, "the number of runs must be positive, not 0"},
+		{sensitivity.Config{Runs: 1, Sampling: 5}, "unknown sampling method 5"},
+		{sensitivity.Config{Runs: 1, Percentiles: []float64{101}}, "percentile 101 isn't between 0 and 100"},
+		{sensitivity.Config{Runs: 1, Params: []sensitivity.Param{{Name: "rate"}}},
+			"rate: missing distribution"},
+		{sensitivity.Config{Runs: 1, Params: []sensitivity.Param{{Name: "nothing", Dist: uniform}}},
+			"unknown variable 'nothing'"},
+		{sensitivity.Config{Runs: 1, Params: []sensitivity.Param{{Name: "births", Dist: uniform}}},
+			"'births' isn't a constant"},
+		{sensitivity.Config{Runs: 1, Outputs: []string{"nothing"}}, "unknown output 'nothing'"},
+	}
+	s := growth(t)
+	for _, c := range cases {
+		_, err := sensitivity.Run(s, c.config)
+		if err == nil || !strings.Contains(err.Error(), c.err) {
+			t.Errorf("expected error containing '%s', got %v", c.err, err)
+		}
+	}
+}
@@ -0,0 +1,463 @@
+// Copyright 2013 Bobby Powers. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package sim
+
+import (
+	"fmt"
+	"go/token"
+	"math"
+	"strconv"
+	"strings"
+
+	"github.com/bpowers/go-xmile/xmile"
+)
+
+// Sim is a compiled model, ready to be run.  A Sim is not modified
+// by Run, so a single Sim may be run multiple times, and concurrently.
+type Sim struct {
+	spec     xmile.SimSpec
+	behavior *xmile.Behavior      // file-wide defaults, or nil
+	models   []*xmile.Model       // the models modules can refer to
+	fset     *token.FileSet       // positions within every parsed equation
+	vars     []*variable          // every variable, indexed by slot
+	byName   map[string]*variable // canonical name -> variable
+	dims     map[string]*dimension
+	arrays   map[string]*array   // canonical name -> arrayed variable
+	macros   map[string]*Builtin // upper case name -> macro
+	stocks   []*variable
+	// initials contains every variable, in the order their
+	// initial values must be calculated.
+	initials []*variable
+	// flows contains auxiliaries and flows, in the order they
+	// must be calculated at every time step.
+	flows     []*variable
+	steps     int
+	saveEvery int // results are saved every saveEvery steps
+	method    method
+	pipelines []*pipeline // calls to DELAY, which record their input
+	randoms   []*random   // calls to random builtins
+	// nonNegStocks are the stocks whose outflows are limited to
+	// keep them from going negative.
+	nonNegStocks []*variable
+	conveyors    []*conveyor
+	queues       []*queue
+	ovens        []*oven
+	// discrete contains the conveyors, queues and ovens, in the
+	// order they are declared.
+	discrete []discreteStock
+}
+
+// discreteStock is a stock updated once per time step by its own
+// rules, rather than integrated.
+type discreteStock interface {
+	// start sets up the stock's state from its initial value.
+	start(r *run)
+	// limitFlows adjusts the stock's flows, once they have been
+	// calculated, to what the stock allows.
+	limitFlows(r *run)
+	// capture saves the state needed to update the stock at the
+	// end of the time step.
+	capture(r *run)
+	// update advances the stock by a time step.
+	update(r *run)
+}
+
+// Results contains the values of every variable at each saved time
+// step of a simulation run.
+type Results struct {
+	Time   []float64
+	Values map[string][]float64 // keyed by canonical variable name
+}
+
+// Lookup returns the series of values for the named variable.  The
+// name does not need to be in canonical form.
+func (r *Results) Lookup(name string) ([]float64, bool) {
+	series, ok := r.Values[CanonicalName(name)]
+	return series, ok
+}
+
+// New compiles the root model of the given file, which is the first
+// model without a name, or the first model if all of them are named.
+func New(f *xmile.File) (*Sim, error) {
+	if len(f.Models) == 0 {
+		return nil, fmt.Errorf("file contains no models")
+	}
+	root := f.Models[0]
+	for _, m := range f.Models {
+		if m.Name == "" {
+			root = m
+			break
+		}
+	}
+	return NewModel(f, root)
+}
+
+// NewModel compiles the model m using the simulation specs of file
+// f.  The model need not be one of f.Models.
+func NewModel(f *xmile.File, m *xmile.Model) (*Sim, error) {
+	s := &Sim{
+		spec:     f.SimSpec,
+		behavior: f.Behavior,
+		models:   f.Models,
+		fset:     token.NewFileSet(),
+		byName:   make(map[string]*variable),
+		dims:     make(map[string]*dimension),
+		arrays:   make(map[string]*array),
+		macros:   make(map[string]*Builtin),
+	}
+	if err := s.checkSpec(); err != nil {
+		return nil, err
+	}
+	for _, xd := range f.Dimensions {
+		d, err := newDimension(xd)
+		if err != nil {
+			return nil, err
+		}
+		s.dims[d.name] = d
+	}
+	if err := s.declareMacros(f.Macros); err != nil {
+		return nil, err
+	}
+	if err := s.compile(m); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+func (s *Sim) checkSpec() error {
+	spec := &s.spec
+	if spec.DT <= 0 {
+		return fmt.Errorf("dt must be positive, not %g", spec.DT)
+	} else if spec.Stop < spec.Start {
+		return fmt.Errorf("stop (%g) is before start (%g)", spec.Stop, spec.Start)
+	}
+	s.steps = int(math.Floor((spec.Stop-spec.Start)/spec.DT + 0.5))
+
+	var err error
+	if s.saveEvery, err = parseSaveStep(spec.SaveStep, spec.DT); err != nil {
+		return err
+	}
+	s.method, err = parseMethod(spec.Method)
+	return err
+}
+
+// parseSaveStep returns the number of time steps between saved
+// results.  An empty save step means results are saved at every time
+// step.
+func parseSaveStep(saveStep string, dt float64) (int, error) {
+	saveStep = strings.TrimSpace(saveStep)
+	if saveStep == "" {
+		return 1, nil
+	}
+	ss, err := strconv.ParseFloat(saveStep, 64)
+	if err != nil {
+		return 0, fmt.Errorf("bad save_step '%s'", saveStep)
+	} else if ss <= 0 {
+		return 0, fmt.Errorf("save_step must be positive, not %g", ss)
+	}
+	ratio := ss / dt
+	n := math.Floor(ratio + 0.5)
+	if n < 1 || math.Abs(ratio-n) > 1e-9*ratio {
+		return 0, fmt.Errorf("save_step (%g) is not a multiple of dt (%g)", ss, dt)
+	}
+	return int(n), nil
+}
+
+// method is a numerical integration method.
+type method int
+
+const (
+	euler method = iota
+	rk2
+	rk4
+)
+
+func parseMethod(name string) (method, error) {
+	switch strings.ToLower(strings.TrimSpace(name)) {
+	case "", "euler":
+		return euler, nil
+	case "rk2":
+		return rk2, nil
+	case "rk4":
+		return rk4, nil
+	}
+	return 0, fmt.Errorf("unsupported integration method '%s'", name)
+}
+
+// run holds the state of a single simulation run.
+type run struct {
+	s    *Sim
+	time float64
+	dt   float64
+	step int       // the number of time steps taken
+	curr []float64 // current value of every variable, by slot
+	// fixed is set for the slots of the constants given values
+	// by Options.Constants, whose equations aren't evaluated.
+	fixed []bool
+
+	// scratch space for the Runge-Kutta methods, indexed like
+	// s.stocks.
+	y0 []float64
+	k  [4][]float64
+
+	// histories holds the past inputs of each of s.pipelines.
+	histories []history
+	belts     []belt // the state of each of s.conveyors
+	lines     []line // the state of each of s.queues
+	bakes     []bake // the state of each of s.ovens
+	// streams holds the random numbers of each of s.randoms.
+	streams []stream
+}
+
+// Options control a single run of a simulation.
+type Options struct {
+	// Seed seeds the random number builtins.  Runs with the same
+	// seed give identical results.
+	Seed int64
+	// Constants replaces the values of constants, variables whose
+	// equations are a number or arithmetic on numbers, keyed by
+	// variable name.  For stocks it replaces the initial value.
+	Constants map[string]float64
+}
+
+// Run simulates the model from start to stop with the integration
+// method named by SimSpec.Method, and returns the value of every
+// variable at every SimSpec.SaveStep.  Values at the stop time are
+// always included.
+func (s *Sim) Run() (*Results, error) {
+	return s.RunWith(Options{})
+}
+
+// RunWith is like Run, with the given options.  A Sim isn't changed
+// by running it, so runs with different options may be made
+// concurrently.
+func (s *Sim) RunWith(opts Options) (*Results, error) {
+	r := &run{
+		s:     s,
+		time:  s.spec.Start,
+		dt:    s.spec.DT,
+		curr:  make([]float64, len(s.vars)),
+		fixed: make([]bool, len(s.vars)),
+		y0:    make([]float64, len(s.stocks)),
+
+		histories: make([]history, len(s.pipelines)),
+		belts:     make([]belt, len(s.conveyors)),
+		lines:     make([]line, len(s.queues)),
+		bakes:     make([]bake, len(s.ovens)),
+		streams:   make([]stream, len(s.randoms)),
+	}
+	for i := range r.k {
+		r.k[i] = make([]float64, len(s.stocks))
+	}
+	for i, c := range s.conveyors {
+		r.belts[i] = c.newBelt()
+	}
+	for i, q := range s.queues {
+		r.lines[i] = q.newLine()
+	}
+	for i, x := range s.randoms {
+		r.streams[i] = x.newStream(opts.Seed)
+	}
+
+	saves := s.steps/s.saveEvery + 2
+	res := &Results{
+		Time:   make([]float64, 0, saves),
+		Values: make(map[string][]float64, len(s.vars)),
+	}
+	for _, v := range s.vars {
+		if !v.implicit {
+			res.Values[v.name] = make([]float64, 0, saves)
+		}
+	}
+
+	for name, value := range opts.Constants {
+		v, ok := s.byName[CanonicalName(name)]
+		if !ok {
+			return nil, fmt.Errorf("unknown variable '%s'", name)
+		} else if !v.isConstant() {
+			return nil, fmt.Errorf("'%s' isn't a constant", name)
+		}
+		r.curr[v.slot] = value
+		r.fixed[v.slot] = true
+	}
+
+	for _, v := range s.initials {
+		if !r.fixed[v.slot] {
+			r.curr[v.slot] = v.eqn.eval(r)
+		}
+	}
+	for _, d := range s.discrete {
+		d.start(r)
+	}
+
+	for step := 0; ; step++ {
+		r.step = step
+		r.calcFlows()
+		r.record()
+		for _, d := range s.discrete {
+			d.capture(r)
+		}
+		if step%s.saveEvery == 0 || step == s.steps {
+			r.save(res)
+		}
+		if step == s.steps {
+			break
+		}
+		switch s.method {
+		case euler:
+			r.eulerStep()
+		case rk2:
+			r.rk2Step()
+		case rk4:
+			r.rk4Step()
+		}
+		for _, d := range s.discrete {
+			d.update(r)
+		}
+		r.time = s.spec.Start + float64(step+1)*r.dt
+	}
+
+	return res, nil
+}
+
+// calcFlows evaluates every auxiliary and flow given the current
+// values of the stocks, and then limits the outflows of non-negative
+// stocks and the flows of discrete stocks.
+func (r *run) calcFlows() {
+	for _, v := range r.s.flows {
+		if !r.fixed[v.slot] {
+			r.curr[v.slot] = v.eqn.eval(r)
+		}
+	}
+	for _, v := range r.s.nonNegStocks {
+		r.limitOutflows(v)
+	}
+	for _, d := range r.s.discrete {
+		d.limitFlows(r)
+	}
+}
+
+// limitOutflows reduces the outflows of the stock v so that it
+// doesn't go negative over the next time step.  As in the XMILE
+// spec, outflows are served in the order they are listed: each takes
+// what it can of the stock and its inflows, and later outflows get
+// what remains.
+func (r *run) limitOutflows(v *variable) {
+	available := r.curr[v.slot]
+	for _, in := range v.inflows {
+		available += r.dt * r.curr[in.slot]
+	}
+	for _, out := range v.outflows {
+		rate := r.curr[out.slot]
+		if rate > 0 && rate*r.dt > available {
+			rate = math.Max(available/r.dt, 0)
+			r.curr[out.slot] = rate
+		}
+		available -= rate * r.dt
+	}
+}
+
+// eulerStep advances every stock by a single time step.
+func (r *run) eulerStep() {
+	for _, v := range r.s.stocks {
+		r.curr[v.slot] += r.dt * r.netFlow(v)
+	}
+}
+
+// rk2Step advances every stock by a single time step with Heun's
+// method, the second order Runge-Kutta method used by STELLA and
+// iThink.  It expects flows to have been calculated at the start of
+// the step.
+func (r *run) rk2Step() {
+	t0, dt := r.time, r.dt
+	k1, k2 := r.k[0], r.k[1]
+
+	r.derivs(k1)
+	r.stashStocks()
+	r.advance(k1, dt)
+	r.time = t0 + dt
+	r.calcFlows()
+	r.derivs(k2)
+
+	for i, v := range r.s.stocks {
+		r.curr[v.slot] = r.y0[i] + dt/2*(k1[i]+k2[i])
+	}
+	r.time = t0
+}
+
+// rk4Step advances every stock by a single time step with the
+// classical fourth order Runge-Kutta method.  It expects flows to
+// have been calculated at the start of the step.
+func (r *run) rk4Step() {
+	t0, dt := r.time, r.dt
+	k1, k2, k3, k4 := r.k[0], r.k[1], r.k[2], r.k[3]
+
+	r.derivs(k1)
+	r.stashStocks()
+
+	r.advance(k1, dt/2)
+	r.time = t0 + dt/2
+	r.calcFlows()
+	r.derivs(k2)
+
+	r.advance(k2, dt/2)
+	r.calcFlows()
+	r.derivs(k3)
+
+	r.advance(k3, dt)
+	r.time = t0 + dt
+	r.calcFlows()
+	r.derivs(k4)
+
+	for i, v := range r.s.stocks {
+		r.curr[v.slot] = r.y0[i] + dt/6*(k1[i]+2*k2[i]+2*k3[i]+k4[i])
+	}
+	r.time = t0
+}
+
+// derivs stores the net flow of each stock in k.
+func (r *run) derivs(k []float64) {
+	for i, v := range r.s.stocks {
+		k[i] = r.netFlow(v)
+	}
+}
+
+// stashStocks saves the value of every stock at the start of a time
+// step in r.y0.
+func (r *run) stashStocks() {
+	for i, v := range r.s.stocks {
+		r.y0[i] = r.curr[v.slot]
+	}
+}
+
+// advance sets each stock to its value at the start of the time step
+// plus h times the corresponding entry in k.
+func (r *run) advance(k []float64, h float64) {
+	for i, v := range r.s.stocks {
+		r.curr[v.slot] = r.y0[i] + h*k[i]
+	}
+}
+
+// netFlow returns the sum of v's inflows minus the sum of its
+// outflows.
+func (r *run) netFlow(v *variable) float64 {
+	var net float64
+	for _, in := range v.inflows {
+		net += r.curr[in.slot]
+	}
+	for _, out := range v.outflows {
+		net -= r.curr[out.slot]
+	}
+	return net
+}
+
+func (r *run) save(res *Results) {
+	res.Time = append(res.Time, r.time)
+	for _, v := range r.s.vars {
+		if !v.implicit {
+			res.Values[v.name] = append(res.Values[v.name], r.curr[v.slot])
+		}
+	}
+}
@@ -0,0 +1,447 @@
+// Copyright 2013 Bobby Powers. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package sim_test
+
+import (
+	"encoding/xml"
+	"io/ioutil"
+	"math"
+	"strings"
+	"testing"
+
+	"github.com/bpowers/go-xmile/compat"
+	"github.com/bpowers/go-xmile/sim"
+	"github.com/bpowers/go-xmile/xmile"
+)
+
+func stock(name, eqn string, inflows, outflows []string) *xmile.Variable {
+	return &xmile.Variable{
+		XMLName:  xml.Name{Local: "stock"},
+		Name:     name,
+		Eqn:      eqn,
+		Inflows:  inflows,
+		Outflows: outflows,
+	}
+}
+
+func flow(name, eqn string) *xmile.Variable {
+	return &xmile.Variable{XMLName: xml.Name{Local: "flow"}, Name: name, Eqn: eqn}
+}
+
+func aux(name, eqn string) *xmile.Variable {
+	return &xmile.Variable{XMLName: xml.Name{Local: "aux"}, Name: name, Eqn: eqn}
+}
+
+func newFile(start, stop, dt float64, vars ...*xmile.Variable) *xmile.File {
+	f := xmile.NewFile(1, "test")
+	f.SimSpec = xmile.SimSpec{Start: start, Stop: stop, DT: dt}
+	f.Models = append(f.Models, &xmile.Model{Variables: vars})
+	return f
+}
+
+func run(t *testing.T, f *xmile.File) *sim.Results {
+	s, err := sim.New(f)
+	if err != nil {
+		t.Fatalf("sim.New: %s", err)
+	}
+	res, err := s.Run()
+	if err != nil {
+		t.Fatalf("Run: %s", err)
+	}
+	return res
+}
+
+func expectSeries(t *testing.T, res *sim.Results, name string, expected []float64) {
+	series, ok := res.Lookup(name)
+	if !ok {
+		t.Fatalf("no results for '%s'", name)
+	}
+	if len(series) != len(expected) {
+		t.Fatalf("%s: expected %d values, got %d (%v)", name, len(expected), len(series), series)
+	}
+	for i := range expected {
+		if math.Abs(series[i]-expected[i]) > 1e-9 {
+			t.Errorf("%s[%d] (t=%g): expected %g, got %g",
+				name, i, res.Time[i], expected[i], series[i])
+		}
+	}
+}
+
+func TestEuler(t *testing.T) {
+	f := newFile(0, 3, 1,
+		stock("Population", "100", []string{"births"}, []string{"deaths"}),
+		flow("births", "population*birth_rate"),
+		flow("deaths", "5"),
+		aux("birth rate", "double_rate/2"),
+		aux("double_rate", ".2"),
+	)
+	res := run(t, f)
+
+	if len(res.Time) != 4 || res.Time[3] != 3 {
+		t.Errorf("unexpected times: %v", res.Time)
+	}
+	expectSeries(t, res, "population", []float64{100, 105, 110.5, 116.55})
+	expectSeries(t, res, "births", []float64{10, 10.5, 11.05, 11.655})
+	expectSeries(t, res, "Birth_Rate", []float64{.1, .1, .1, .1})
+}
+
+func TestStockInitialDependsOnAux(t *testing.T) {
+	f := newFile(0, 1, .5,
+		stock("s", "init*2", []string{"in"}, nil),
+		flow("in", "s"),
+		aux("init", "3"),
+	)
+	res := run(t, f)
+	expectSeries(t, res, "s", []float64{6, 9, 13.5})
+}
+
+func TestCompileErrors(t *testing.T) {
+	cases := []struct {
+		vars []*xmile.Variable
+		err  string
+	}{
+		{[]*xmile.Variable{aux("a", "b"), aux("b", "a")}, "circular"},
+		{[]*xmile.Variable{aux("a", "b")}, "unknown variable"},
+		{[]*xmile.Variable{aux("a", "1"), aux("A", "2")}, "duplicate"},
+		{[]*xmile.Variable{aux("a", "")}, "missing equation"},
+		{[]*xmile.Variable{stock("s", "1", []string{"a"}, nil), aux("a", "1")}, "not a flow"},
+		{[]*xmile.Variable{stock("s", "a", nil, nil), aux("a", "s")}, "circular"},
+	}
+	for _, c := range cases {
+		_, err := sim.New(newFile(0, 1, 1, c.vars...))
+		if err == nil || !strings.Contains(err.Error(), c.err) {
+			t.Errorf("expected error containing '%s', got %v", c.err, err)
+		}
+	}
+
+	if _, err := sim.New(newFile(0, 1, 0, aux("a", "1"))); err == nil {
+		t.Errorf("expected error for zero dt")
+	}
+}
+
+func TestIntegrationMethods(t *testing.T) {
+	// dy/dt = y with y(0) = 1.  Each method multiplies y by a
+	// truncated Taylor series of e^h at every step.
+	const h = .1
+	cases := []struct {
+		method string
+		factor float64
+	}{
+		{"", 1 + h},
+		{"Euler", 1 + h},
+		{"RK2", 1 + h + h*h/2},
+		{"rk4", 1 + h + h*h/2 + h*h*h/6 + h*h*h*h/24},
+	}
+	for _, c := range cases {
+		f := newFile(0, 1, h,
+			stock("y", "1", []string{"growth"}, nil),
+			flow("growth", "y"),
+		)
+		f.SimSpec.Method = c.method
+		res := run(t, f)
+		expected := make([]float64, 11)
+		for i := range expected {
+			expected[i] = math.Pow(c.factor, float64(i))
+		}
+		expectSeries(t, res, "y", expected)
+	}
+}
+
+func TestUnknownMethod(t *testing.T) {
+	f := newFile(0, 1, 1, aux("a", "1"))
+	f.SimSpec.Method = "Gear"
+	if _, err := sim.New(f); err == nil || !strings.Contains(err.Error(), "Gear") {
+		t.Errorf("expected unsupported method error, got %v", err)
+	}
+}
+
+// lotkaVolterra returns a classic predator-prey model.
+func lotkaVolterra(dt float64, method string) *xmile.File {
+	f := newFile(0, 20, dt,
+		stock("prey", "10", []string{"prey_births"}, []string{"prey_deaths"}),
+		stock("predators", "5", []string{"predator_births"}, []string{"predator_deaths"}),
+		flow("prey_births", "prey*1.1"),
+		flow("prey_deaths", "prey*kill_rate"),
+		flow("predator_births", "predators*gain_rate"),
+		flow("predator_deaths", "predators*.4"),
+		aux("kill_rate", "predators*.4"),
+		aux("gain_rate", "prey*.1"),
+	)
+	f.SimSpec.Method = method
+	return f
+}
+
+func final(t *testing.T, res *sim.Results, name string) float64 {
+	series, ok := res.Lookup(name)
+	if !ok {
+		t.Fatalf("no results for '%s'", name)
+	}
+	return series[len(series)-1]
+}
+
+func TestRK4Convergence(t *testing.T) {
+	fine := run(t, lotkaVolterra(1.0/512, "RK4"))
+	rk4 := run(t, lotkaVolterra(.125, "RK4"))
+	rk2 := run(t, lotkaVolterra(.125, "RK2"))
+	euler := run(t, lotkaVolterra(.125, "Euler"))
+
+	for _, name := range []string{"prey", "predators"} {
+		want := final(t, fine, name)
+		errRK4 := math.Abs(final(t, rk4, name) - want)
+		errRK2 := math.Abs(final(t, rk2, name) - want)
+		errEuler := math.Abs(final(t, euler, name) - want)
+		if errRK4 > 1e-3*want {
+			t.Errorf("%s: RK4 error too large: %g (want %g)", name, errRK4, want)
+		}
+		if !(errRK4 < errRK2 && errRK2 < errEuler) {
+			t.Errorf("%s: expected RK4 (%g) < RK2 (%g) < Euler (%g) error",
+				name, errRK4, errRK2, errEuler)
+		}
+	}
+}
+
+// readIsee loads an isee systems model, converting it to XMILE.
+func readIsee(t *testing.T, path string) *xmile.File {
+	contents, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatalf("ioutil.ReadFile: %s", err)
+	}
+	iseeFile, err := compat.ReadFile(contents)
+	if err != nil {
+		t.Fatalf("compat.ReadFile: %s", err)
+	}
+	f, err := compat.ConvertFromIsee(iseeFile, true)
+	if err != nil {
+		t.Fatalf("compat.ConvertFromIsee: %s", err)
+	}
+	return f.(*xmile.File)
+}
+
+func TestPredPreyRK4(t *testing.T) {
+	f := readIsee(t, "../models/pred_prey.stmx")
+	// the model starts in equilibrium, so knock it out with the
+	// lynx harvest at t=4.
+	for _, v := range f.Models[0].Variables {
+		if v.Name == `size_of_1_time_\nlynx_harvest` {
+			v.Eqn = "100"
+		}
+	}
+	f.SimSpec.SaveStep = "5"
+	res := run(t, f)
+
+	// reference values from an independent RK4 implementation of
+	// the same model, in which the harvest flows for the whole
+	// time step starting at t=4.
+	expected := []struct {
+		time, hares, lynx float64
+	}{
+		{0, 50000, 1250},
+		{5, 54693.91719, 1162.837332},
+		{10, 47330.47987, 1350.766935},
+		{15, 48427.4062, 1151.484881},
+		{20, 53886.60858, 1345.986599},
+		{25, 43457.98712, 1182.722346},
+		{30, 58959.81204, 1290.250017},
+		{35, 41382.5989, 1242.663843},
+		{40, 59143.2255, 1215.190431},
+		{45, 42774.99528, 1308.618493},
+		{50, 54527.18495, 1161.903774},
+		{55, 47497.44492, 1351.375575},
+		{60, 48261.75144, 1151.817032},
+	}
+	hares, _ := res.Lookup("Hares")
+	lynx, _ := res.Lookup("Lynx")
+	if len(res.Time) != len(expected) {
+		t.Fatalf("expected %d saved steps, got %d", len(expected), len(res.Time))
+	}
+	for i, e := range expected {
+		if res.Time[i] != e.time {
+			t.Errorf("time[%d]: expected %g, got %g", i, e.time, res.Time[i])
+		}
+		if math.Abs(hares[i]-e.hares) > 1e-9*e.hares || math.Abs(lynx[i]-e.lynx) > 1e-9*e.lynx {
+			t.Errorf("t=%g: expected hares %g, lynx %g, got %g, %g",
+				e.time, e.hares, e.lynx, hares[i], lynx[i])
+		}
+	}
+}
+
+func TestSaveStep(t *testing.T) {
+	f := newFile(0, 1, .125,
+		stock("s", "0", []string{"in"}, nil),
+		flow("in", "8"),
+	)
+	f.SimSpec.SaveStep = ".375"
+	res := run(t, f)
+
+	expectedTime := []float64{0, .375, .75, 1}
+	if len(res.Time) != len(expectedTime) {
+		t.Fatalf("expected times %v, got %v", expectedTime, res.Time)
+	}
+	for i := range expectedTime {
+		if res.Time[i] != expectedTime[i] {
+			t.Errorf("time[%d]: expected %g, got %g", i, expectedTime[i], res.Time[i])
+		}
+	}
+	expectSeries(t, res, "s", []float64{0, 3, 6, 8})
+	expectSeries(t, res, "in", []float64{8, 8, 8, 8})
+}
+
+func TestBadSaveStep(t *testing.T) {
+	for _, ss := range []string{".3", "0", "-1", "often"} {
+		f := newFile(0, 1, .25, aux("a", "1"))
+		f.SimSpec.SaveStep = ss
+		if _, err := sim.New(f); err == nil {
+			t.Errorf("expected error for save_step '%s'", ss)
+		}
+	}
+}
+
+func TestGF(t *testing.T) {
+	effect := aux("effect", "TIME_input")
+	effect.GF = &xmile.GF{
+		XPoints: "0,2",
+		YPoints: "0,1",
+	}
+	f := newFile(0, 4, 1,
+		stock("time_input", "0", []string{"clock"}, nil),
+		flow("clock", "1"),
+		effect,
+	)
+	res := run(t, f)
+	expectSeries(t, res, "effect", []float64{0, .5, 1, 1, 1})
+}
+
+func TestOperators(t *testing.T) {
+	f := newFile(0, 0, 1,
+		aux("a", "2"),
+		aux("b", "3"),
+		aux("precedence", "a + b * a ^ 2"),
+		aux("gt", "b > a"),
+		aux("le", "b <= a"),
+		aux("eq", "a = 2 AND b <> 2"),
+		aux("or", "a > b OR NOT (b < a)"),
+		aux("mod", "8 MOD b - 7 MOD a"),
+	)
+	res := run(t, f)
+	expectSeries(t, res, "precedence", []float64{14})
+	expectSeries(t, res, "gt", []float64{1})
+	expectSeries(t, res, "le", []float64{0})
+	expectSeries(t, res, "eq", []float64{1})
+	expectSeries(t, res, "or", []float64{1})
+	expectSeries(t, res, "mod", []float64{1})
+}
+
+func TestIf(t *testing.T) {
+	f := newFile(0, 3, 1,
+		stock("s", "0", []string{"in"}, nil),
+		flow("in", "IF s >= 2 THEN 0 ELSE 1"),
+		aux("safe", "IF s = 0 THEN 0 ELSE 1 / s"),
+	)
+	res := run(t, f)
+	expectSeries(t, res, "s", []float64{0, 1, 2, 2})
+	expectSeries(t, res, "safe", []float64{0, 1, .5, .5})
+}
+
+func TestUnary(t *testing.T) {
+	f := newFile(0, 0, 1,
+		aux("a", "3"),
+		aux("neg_square", "-a^2"),
+		aux("square_neg", "(-a)^2"),
+		aux("recip", "2^-1"),
+		aux("mixed", "a * -2 + +a"),
+	)
+	res := run(t, f)
+	expectSeries(t, res, "neg_square", []float64{-9})
+	expectSeries(t, res, "square_neg", []float64{9})
+	expectSeries(t, res, "recip", []float64{.5})
+	expectSeries(t, res, "mixed", []float64{-3})
+}
+
+func nonNegative(v *xmile.Variable, contents string) *xmile.Variable {
+	e := xmile.Exister(contents)
+	v.NonNeg = &e
+	return v
+}
+
+func TestUniflow(t *testing.T) {
+	res := run(t, newFile(0, 3, 1,
+		stock("s", "8", nil, []string{"drain"}),
+		nonNegative(flow("drain", "4"), ""),
+		nonNegative(flow("uni", "s - 6"), ""),
+		flow("bi", "s - 6"),
+	))
+	// the stock itself isn't non-negative
+	expectSeries(t, res, "s", []float64{8, 4, 0, -4})
+	expectSeries(t, res, "uni", []float64{2, 0, 0, 0})
+	expectSeries(t, res, "bi", []float64{2, -2, -6, -10})
+}
+
+func TestNonNegativeStock(t *testing.T) {
+	res := run(t, newFile(0, 2, 1,
+		nonNegative(stock("s", "10", []string{"in"}, []string{"first", "second"}), ""),
+		flow("in", "2"),
+		flow("first", "8"),
+		flow("second", "8"),
+	))
+	// outflows are served in order from the stock and its inflows
+	expectSeries(t, res, "s", []float64{10, 0, 0})
+	expectSeries(t, res, "first", []float64{8, 2, 2})
+	expectSeries(t, res, "second", []float64{4, 0, 0})
+}
+
+func TestRunConstants(t *testing.T) {
+	s, err := sim.New(newFile(0, 2, 1,
+		stock("pop", "10", []string{"births"}, nil),
+		flow("births", "pop * rate"),
+		aux("rate", ".1 * 5"),
+		aux("doubled", "rate * 2"),
+	))
+	if err != nil {
+		t.Fatalf("sim.New: %s", err)
+	}
+	res, err := s.RunWith(sim.Options{Constants: map[string]float64{"Pop": 100, "rate": 1}})
+	if err != nil {
+		t.Fatalf("Run: %s", err)
+	}
+	expectSeries(t, res, "pop", []float64{100, 200, 400})
+	expectSeries(t, res, "doubled", []float64{2, 2, 2})
+
+	// the Sim itself is unchanged
+	res, err = s.Run()
+	if err != nil {
+		t.Fatalf("Run: %s", err)
+	}
+	expectSeries(t, res, "pop", []float64{10, 15, 22.5})
+
+	for name, err := range map[string]string{
+		"nothing": "unknown variable 'nothing'",
+		"births":  "'births' isn't a constant",
+		"doubled": "'doubled' isn't a constant",
+	} {
+		_, got := s.RunWith(sim.Options{Constants: map[string]float64{name: 1}})
+		if got == nil || !strings.Contains(got.Error(), err) {
+			t.Errorf("expected error containing '%s', got %v", err, got)
+		}
+	}
+}
+
+func TestNonNegativeDefault(t *testing.T) {
+	f := newFile(0, 2, 1,
+		stock("default", "1", nil, []string{"out1"}),
+		nonNegative(stock("overridden", "1", nil, []string{"out2"}), "false"),
+		flow("out1", "1"),
+		flow("out2", "1"),
+		flow("bi", "-1"),
+		aux("smoothed", "SMTH1(-10, 1, 0)"),
+	)
+	f.Behavior = &xmile.Behavior{NonNegative: true}
+	res := run(t, f)
+	expectSeries(t, res, "default", []float64{1, 0, 0})
+	expectSeries(t, res, "overridden", []float64{1, 0, -1})
+	// flows are uniflows by default too
+	expectSeries(t, res, "bi", []float64{0, 0, 0})
+	// but the stocks of builtins aren't affected
+	expectSeries(t, res, "smoothed", []float64{0, -10, -10})
+}
@@ -49,12 +49,29 @@ type (
 		Rparen token.Pos // position of ")"
 	}
 
-	// An IndexExpr node represents an expression followed by an index.
+	// An IndexExpr node represents an expression followed by a
+	// list of subscripts, one per dimension, as in pop[region, 1].
+	// Subscripts naming a dimension are represented as Idents.
 	IndexExpr struct {
-		X      Expr      // expression
-		Lbrack token.Pos // position of "["
-		Index  Expr      // index expression
-		Rbrack token.Pos // position of "]"
+		X       Expr      // expression
+		Lbrack  token.Pos // position of "["
+		Indices []Expr    // index expressions
+		Rbrack  token.Pos // position of "]"
+	}
+
+	// A WildcardExpr node represents a "*" subscript, selecting
+	// every element of a dimension, optionally qualified with the
+	// dimension's name as in "*:region".
+	WildcardExpr struct {
+		Star token.Pos // position of "*"
+		Dim  *Ident    // dimension name; or nil
+	}
+
+	// A TransposeExpr node represents an array followed by the
+	// transposition operator "'".
+	TransposeExpr struct {
+		X     Expr      // array expression
+		Quote token.Pos // position of "'"
 	}
 
 	// A CallExpr node represents an expression followed by an argument list.
@@ -81,37 +98,59 @@ type (
 		Op    token.Token // operator
 		Y     Expr        // right operand
 	}
+
+	// An IfExpr node represents an IF THEN ELSE expression.
+	IfExpr struct {
+		If   token.Pos // position of "IF"
+		Cond Expr      // condition
+		Then Expr      // value when Cond is non-zero
+		Else Expr      // value when Cond is zero
+	}
 )
 
-func (x *BadExpr) Pos() token.Pos    { return x.From }
-func (x *Ident) Pos() token.Pos      { return x.NamePos }
-func (x *BasicLit) Pos() token.Pos   { return x.ValuePos }
-func (x *ParenExpr) Pos() token.Pos  { return x.Lparen }
-func (x *IndexExpr) Pos() token.Pos  { return x.X.Pos() }
-func (x *CallExpr) Pos() token.Pos   { return x.Fun.Pos() }
-func (x *UnaryExpr) Pos() token.Pos  { return x.OpPos }
-func (x *BinaryExpr) Pos() token.Pos { return x.X.Pos() }
-
-func (x *BadExpr) End() token.Pos    { return x.To }
-func (x *Ident) End() token.Pos      { return token.Pos(int(x.NamePos) + len(x.Name)) }
-func (x *BasicLit) End() token.Pos   { return token.Pos(int(x.ValuePos) + len(x.Value)) }
-func (x *ParenExpr) End() token.Pos  { return x.Rparen + 1 }
-func (x *IndexExpr) End() token.Pos  { return x.Rbrack + 1 }
-func (x *CallExpr) End() token.Pos   { return x.Rparen + 1 }
-func (x *UnaryExpr) End() token.Pos  { return x.X.End() }
-func (x *BinaryExpr) End() token.Pos { return x.Y.End() }
+func (x *BadExpr) Pos() token.Pos       { return x.From }
+func (x *Ident) Pos() token.Pos         { return x.NamePos }
+func (x *BasicLit) Pos() token.Pos      { return x.ValuePos }
+func (x *ParenExpr) Pos() token.Pos     { return x.Lparen }
+func (x *IndexExpr) Pos() token.Pos     { return x.X.Pos() }
+func (x *WildcardExpr) Pos() token.Pos  { return x.Star }
+func (x *TransposeExpr) Pos() token.Pos { return x.X.Pos() }
+func (x *CallExpr) Pos() token.Pos      { return x.Fun.Pos() }
+func (x *UnaryExpr) Pos() token.Pos     { return x.OpPos }
+func (x *BinaryExpr) Pos() token.Pos    { return x.X.Pos() }
+func (x *IfExpr) Pos() token.Pos        { return x.If }
+
+func (x *BadExpr) End() token.Pos   { return x.To }
+func (x *Ident) End() token.Pos     { return token.Pos(int(x.NamePos) + len(x.Name)) }
+func (x *BasicLit) End() token.Pos  { return token.Pos(int(x.ValuePos) + len(x.Value)) }
+func (x *ParenExpr) End() token.Pos { return x.Rparen + 1 }
+func (x *IndexExpr) End() token.Pos { return x.Rbrack + 1 }
+func (x *WildcardExpr) End() token.Pos {
+	if x.Dim != nil {
+		return x.Dim.End()
+	}
+	return x.Star + 1
+}
+func (x *TransposeExpr) End() token.Pos { return x.Quote + 1 }
+func (x *CallExpr) End() token.Pos      { return x.Rparen + 1 }
+func (x *UnaryExpr) End() token.Pos     { return x.X.End() }
+func (x *BinaryExpr) End() token.Pos    { return x.Y.End() }
+func (x *IfExpr) End() token.Pos        { return x.Else.End() }
 
 // exprNode() ensures that only expression/type nodes can be
 // assigned to an ExprNode.
 //
-func (*BadExpr) exprNode()    {}
-func (*Ident) exprNode()      {}
-func (*BasicLit) exprNode()   {}
-func (*ParenExpr) exprNode()  {}
-func (*IndexExpr) exprNode()  {}
-func (*CallExpr) exprNode()   {}
-func (*UnaryExpr) exprNode()  {}
-func (*BinaryExpr) exprNode() {}
+func (*BadExpr) exprNode()       {}
+func (*Ident) exprNode()         {}
+func (*BasicLit) exprNode()      {}
+func (*ParenExpr) exprNode()     {}
+func (*IndexExpr) exprNode()     {}
+func (*WildcardExpr) exprNode()  {}
+func (*TransposeExpr) exprNode() {}
+func (*CallExpr) exprNode()      {}
+func (*UnaryExpr) exprNode()     {}
+func (*BinaryExpr) exprNode()    {}
+func (*IfExpr) exprNode()        {}
 
 var noPos token.Pos
 
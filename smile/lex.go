@@ -7,13 +7,13 @@ package smile
 import (
 	"fmt"
 	"go/token"
-	"log"
+	"strconv"
 	"strings"
 	"unicode"
 	"unicode/utf8"
 )
 
-const eof = 0
+const eof = -1
 
 type itemType int
 
@@ -88,16 +88,32 @@ func (t *Token) String() string {
 	return fmt.Sprintf("(%s %s)", t.kind, val)
 }
 
+// describe returns a description of t for use in error messages.
+func (t *Token) describe() string {
+	switch {
+	case t.kind == itemEOF:
+		return "end of equation"
+	case t.kind == itemSemi && t.val == "\n":
+		return "newline"
+	case t.kind == itemSemi:
+		return "';'"
+	case t.kind == itemLiteral:
+		return fmt.Sprintf("\"%s\"", t.val)
+	}
+	return fmt.Sprintf("'%s'", t.val)
+}
+
 type stateFn func() stateFn
 
 type lexer struct {
 	f      *token.File
+	errs   ErrorHandler
 	s      string // the string being scanned
 	pos    int    // current position in the input
 	start  int    // start of this token
 	width  int    // width of the last rune
 	last   *Token
-	items  chan *Token // channel of scanned items
+	items  []*Token // scanned items not yet returned by Token
 	state  stateFn
 	semi   bool
 	peeked *Token
@@ -110,64 +126,74 @@ func (l *lexer) Peek() *Token {
 	return l.peeked
 }
 
-// n=1 lookahead
+// n=1 lookahead.  Once the end of input (or a lexical error) has
+// been reached, Token returns itemEOF tokens indefinitely.
 func (l *lexer) Token() *Token {
 	if l.peeked != nil {
 		p := l.peeked
 		l.peeked = nil
 		return p
 	}
-	for {
-		select {
-		case item := <-l.items:
-			return item
-		default:
-			l.state = l.state()
+	for len(l.items) == 0 {
+		if l.state == nil {
+			return &Token{kind: itemEOF, pos: l.f.Pos(l.pos)}
 		}
+		l.state = l.state()
 	}
-	panic("unreachable")
+	item := l.items[0]
+	l.items = l.items[1:]
+	return item
 }
 
-func newLexer(input string, file *token.File) *lexer {
+// newLexer returns a lexer for input.  Lexical errors are reported to
+// errs, with positions relative to file.
+func newLexer(input string, file *token.File, errs ErrorHandler) *lexer {
 	l := new(lexer)
 	l.f = file
+	l.errs = errs
 	l.s = input
-	l.items = make(chan *Token, 2) // buffered
 	l.state = l.begin
 	return l
 }
 
+// getLine returns the line of input containing pos, without its
+// trailing newline.
 func (l *lexer) getLine(pos token.Position) string {
-	p := pos.Offset - pos.Column
-	if p < 0 || p >= len(l.s) {
-		return fmt.Sprintf("getLine: o%d c%d, len%d",
-			pos.Offset, pos.Column, len(l.s))
+	start := pos.Offset - (pos.Column - 1)
+	if start < 0 || start > len(l.s) || pos.Offset > len(l.s) {
+		return ""
 	}
-	result := l.s[pos.Offset-pos.Column:]
+	result := l.s[start:]
 	if newline := strings.IndexRune(result, '\n'); newline != -1 {
 		result = result[:newline]
 	}
 	return result
 }
 
-func (l *lexer) Error(s string) {
-	pos := l.f.Position(l.last.pos)
+// Error returns msg annotated with pos, followed by the line of input
+// containing pos and a caret pointing at pos's column.
+func (l *lexer) Error(pos token.Position, msg string) string {
 	line := l.getLine(pos)
+	col := pos.Column - 1
+	if col < 0 {
+		col = 0
+	} else if col > len(line) {
+		col = len(line)
+	}
 	// we want the number of spaces (taking into account tabs)
 	// before the problematic token
-	prefixLen := pos.Column + strings.Count(line[:pos.Column], "\t")*7 - 1
+	prefixLen := utf8.RuneCountInString(line[:col]) + strings.Count(line[:col], "\t")*7
 	prefix := strings.Repeat(" ", prefixLen)
 
 	line = strings.Replace(line, "\t", "        ", -1)
 
-	fmt.Printf("%s:%d:%d: error: %s\n", pos.Filename,
-		pos.Line, pos.Column, s)
-	fmt.Printf("%s\n", line)
-	fmt.Printf("%s^\n", prefix)
+	return fmt.Sprintf("%s:%d:%d: error: %s\n%s\n%s^", pos.Filename,
+		pos.Line, pos.Column, msg, line, prefix)
 }
 
 func (l *lexer) next() rune {
 	if l.pos >= len(l.s) {
+		l.width = 0
 		return eof
 	}
 	r, width := utf8.DecodeRuneInString(l.s[l.pos:])
@@ -175,7 +201,8 @@ func (l *lexer) next() rune {
 	l.width = width
 
 	if r == '\n' {
-		l.f.AddLine(l.pos + 1)
+		// the offset of the first character on the next line
+		l.f.AddLine(l.pos)
 	}
 	return r
 }
@@ -218,23 +245,28 @@ func (l *lexer) insertEmit(ty itemType, val string) {
 		kind: ty,
 	}
 	l.last = t
-	l.items <- t
+	l.items = append(l.items, t)
 }
 
 func (l *lexer) emit(ty itemType) {
 	t := &Token{
-		pos:  l.f.Pos(l.pos),
+		pos:  l.f.Pos(l.start),
 		val:  l.s[l.start:l.pos],
 		kind: ty,
 	}
-	//log.Printf("t: %#v\n", t)
 	l.last = t
-	l.items <- t
+	l.items = append(l.items, t)
 	l.ignore()
 
 	switch {
+	case ty == itemIdentifier && isKeyword(t.val):
+		// an equation can't end with an operator, so newlines
+		// after keywords are always continuations.
+		l.semi = false
 	case ty == itemRBracket || ty == itemRParen || ty == itemRSquare:
 		fallthrough
+	case ty == itemOperator && t.val == "'": // postfix transpose
+		fallthrough
 	case ty == itemIdentifier || ty == itemNumber || ty == itemLiteral:
 		l.semi = true
 	default:
@@ -242,8 +274,31 @@ func (l *lexer) emit(ty itemType) {
 	}
 }
 
-func (l *lexer) errorf(format string, args ...interface{}) stateFn {
-	log.Printf(format, args...)
+// keywords are reserved identifiers: word operators like AND, and
+// the parts of IF THEN ELSE expressions.
+var keywords = map[string]bool{
+	"AND":  true,
+	"OR":   true,
+	"NOT":  true,
+	"MOD":  true,
+	"IF":   true,
+	"THEN": true,
+	"ELSE": true,
+}
+
+// isKeyword reports whether the identifier s is a keyword.  Keywords
+// are case-insensitive.
+func isKeyword(s string) bool {
+	return keywords[strings.ToUpper(s)]
+}
+
+// errorf reports an error at the given offset in the input, and
+// stops scanning.
+func (l *lexer) errorf(offset int, format string, args ...interface{}) stateFn {
+	if l.errs != nil {
+		l.errs.Error(l.f.Position(l.f.Pos(offset)), fmt.Sprintf(format, args...))
+	}
+	l.start = offset
 	l.emit(itemEOF)
 	return nil
 }
@@ -271,7 +326,6 @@ func (l *lexer) statement() stateFn {
 		if r == '\n' && l.semi {
 			l.emit(itemSemi)
 		}
-		//		log.Print("1 ignoring:", l.s[l.start:l.pos])
 		l.ignore()
 	case unicode.IsDigit(r) || r == '.':
 		l.backup()
@@ -279,14 +333,16 @@ func (l *lexer) statement() stateFn {
 	case isLiteralStart(r):
 		l.backup()
 		return l.literal
-	case isIdentifierStart(r):
-		l.backup()
-		return l.identifier
+	case r == '\'' && l.transposes():
+		l.emit(itemOperator)
 	case isOperator(r):
 		l.backup()
 		return l.operator
+	case isIdentifierStart(r):
+		l.backup()
+		return l.identifier
 	default:
-		return l.errorf("unrecognized char: %#U\n", r)
+		return l.errorf(l.pos-l.width, "unrecognized char: %#U", r)
 	}
 	return l.statement
 }
@@ -307,6 +363,14 @@ func (l *lexer) operator() stateFn {
 		ty = itemLSquare
 	case r == ']':
 		ty = itemRSquare
+	case r == '<':
+		l.accept("=>")
+	case r == '>':
+		l.accept("=")
+	case r == '&':
+		l.accept("&")
+	case r == '|':
+		l.accept("|")
 	}
 	l.emit(ty)
 	if r == ')' && l.peek() == '(' {
@@ -321,7 +385,6 @@ func (l *lexer) comment() stateFn {
 	for r := l.next(); r != '\n' && r != eof; r = l.next() {
 	}
 	l.backup()
-	//	log.Print("2 ignoring:", l.s[l.start:l.pos])
 	l.ignore()
 	return l.statement
 }
@@ -342,7 +405,6 @@ func (l *lexer) multiComment() stateFn {
 			break
 		}
 	}
-	//	log.Print("2 ignoring:", l.s[l.start:l.pos])
 	l.ignore()
 	return l.statement
 }
@@ -355,6 +417,9 @@ func (l *lexer) number() stateFn {
 		l.accept("+-")
 		l.acceptRun("0123456789")
 	}
+	if _, err := strconv.ParseFloat(l.s[l.start:l.pos], 64); err != nil {
+		return l.errorf(l.start, "malformed number '%s'", l.s[l.start:l.pos])
+	}
 	l.emit(itemNumber)
 	return l.statement
 }
@@ -367,7 +432,8 @@ func (l *lexer) literal() stateFn {
 	l.backup()
 
 	if l.peek() != delim {
-		return l.errorf("unexpected EOF")
+		// point at the opening delimiter
+		return l.errorf(l.start-1, "unterminated literal")
 	}
 	l.emit(itemLiteral)
 	l.next()
@@ -376,26 +442,52 @@ func (l *lexer) literal() stateFn {
 }
 
 func (l *lexer) identifier() stateFn {
-	for isAlphaNumeric(l.next()) {
+	for r := l.next(); isAlphaNumeric(r); r = l.next() {
+		// apostrophes within names, as in farmer's_land,
+		// are part of the name.  At the end of a name they
+		// are transpose operators.
+		if r == '\'' && !isNamePart(l.peek()) {
+			break
+		}
 	}
 	l.backup()
 	l.emit(itemIdentifier)
 	return l.statement
 }
 
+// transposes reports whether the apostrophe just read is a transpose
+// operator, which directly follows a name, a closing bracket or
+// another transpose.
+func (l *lexer) transposes() bool {
+	t := l.last
+	if t == nil || l.start == 0 || unicode.IsSpace(rune(l.s[l.start-1])) {
+		return false
+	}
+	return t.kind == itemIdentifier || t.kind == itemLiteral || t.kind == itemRSquare || t.kind == itemRParen ||
+		t.kind == itemOperator && t.val == "'"
+}
+
+// isNamePart reports whether r can follow an apostrophe within a
+// name.
+func isNamePart(r rune) bool {
+	return r != '\'' && isAlphaNumeric(r)
+}
+
 func isLiteralStart(r rune) bool {
 	return r == '"'
 }
 
 func isOperator(r rune) bool {
-	return strings.IndexRune(",+-*/|&=()[]:><", r) > -1
+	return strings.IndexRune(",+-*/^|&=()[]:><", r) > -1
 }
 
 func isIdentifierStart(r rune) bool {
-	return !(unicode.IsDigit(r) || unicode.IsSpace(r) || isOperator(r))
+	return !(unicode.IsDigit(r) || unicode.IsSpace(r) || isOperator(r) ||
+		unicode.IsControl(r) || r == utf8.RuneError || r == eof)
 }
 
 // isAlphaNumeric reports whether r is an alphabetic, digit, or underscore.
 func isAlphaNumeric(r rune) bool {
-	return !(unicode.IsSpace(r) || isOperator(r) || r == ';' || r == eof)
+	return !(unicode.IsSpace(r) || isOperator(r) || r == ';' || r == '"' ||
+		unicode.IsControl(r) || r == utf8.RuneError || r == eof)
 }
@@ -12,24 +12,34 @@ import (
 )
 
 // Parse returns an abstract syntax tree corresponding to the given
-// equation, or an error.
+// equation, or an error.  Any error is an ErrorList, sorted by
+// position.
 func Parse(name, eqn string) (Expr, error) {
+	return ParseExpr(token.NewFileSet(), name, eqn)
+}
 
+// ParseExpr is like Parse, but adds the equation to fset under the
+// given filename, so that the positions of the returned nodes can be
+// converted to line and column information.
+func ParseExpr(fset *token.FileSet, filename, eqn string) (Expr, error) {
 	// it makes the lexer's code much cleaner to have a rune to
 	// parse that marks the end of the equation
 	if r, _ := utf8.DecodeLastRuneInString(eqn); r != ';' {
 		eqn += ";"
 	}
 
-	fset := token.NewFileSet()
-	f := fset.AddFile(name, fset.Base(), len(eqn))
+	f := fset.AddFile(filename, fset.Base(), len(eqn))
 
-	p := newParser(f, fset, newLexer(eqn, f))
+	p := newParser(f, fset, nil)
+	p.lex = newLexer(eqn, f, &p.errs)
 	ast, ok := p.Parse()
+	if !ok && p.errs.ErrorCount() == 0 {
+		// every failure should have been reported, but make
+		// sure callers never get a nil Expr without an error.
+		p.errorf(p.lex.Peek(), "syntax error")
+	}
 	if p.errs.ErrorCount() != 0 {
 		return nil, p.errs.GetErrorList(Sorted)
-	} else if !ok {
-		return nil, fmt.Errorf("p.Parse(): not ok %#v", p)
 	}
 
 	return ast, nil
@@ -45,10 +55,14 @@ type parser struct {
 
 func newParser(f *token.File, fs *token.FileSet, l *lexer) *parser {
 	p := &parser{tokf: f, fset: fs, lex: l}
+	// levels are ordered from lowest to highest precedence.
 	p.levels = []exprFn{
-		binaryLevelGen(0, p, "^"),
-		binaryLevelGen(1, p, "*/"),
-		binaryLevelGen(2, p, "+-"),
+		binaryLevelGen(0, p, "OR", "||", "|"),
+		binaryLevelGen(1, p, "AND", "&&", "&"),
+		binaryLevelGen(2, p, "=", "<>"),
+		binaryLevelGen(3, p, "<", "<=", ">", ">="),
+		binaryLevelGen(4, p, "+", "-"),
+		binaryLevelGen(5, p, "*", "/", "MOD"),
 		p.factor,
 	}
 	return p
@@ -70,21 +84,29 @@ func (p *parser) Parse() (x Expr, ok bool) {
 	if x, ok = p.expr(); !ok {
 		return
 	}
-	la := p.lex.Peek()
-	if la == nil {
-		panic(fmt.Errorf("parser.Parse('%s'): missing semicolon", p.lex.s))
+	if _, ok = p.consumeTok(itemSemi); !ok {
+		p.errorf(p.lex.Peek(), "expected end of equation, not %s", p.lex.Peek().describe())
+		return nil, false
 	}
-	if la.kind != itemSemi {
-		p.errorf(la, "expected end-of-equation, got %#v", la)
+	// only blank lines and comments may follow the equation
+	for _, ok := p.consumeTok(itemSemi); ok; _, ok = p.consumeTok(itemSemi) {
+	}
+	if la := p.lex.Peek(); la.kind != itemEOF {
+		p.errorf(la, "unexpected %s after end of equation", la.describe())
 		return nil, false
 	}
-	p.lex.Token() // consume
 	return
 }
 
+// errorf records an error at the position of tok.  Once the lexer
+// has reported an error it returns itemEOF tokens, so errors at EOF
+// after that point are only noise and are dropped.
 func (p *parser) errorf(tok *Token, f string, args ...interface{}) {
 	var pos token.Position
 	if tok != nil {
+		if tok.kind == itemEOF && p.errs.ErrorCount() > 0 {
+			return
+		}
 		pos = p.fset.Position(tok.pos)
 	}
 	p.errs.Error(pos, fmt.Sprintf(f, args...))
@@ -95,7 +117,7 @@ func floatLit(t *Token) *BasicLit {
 }
 
 func opToken(t *Token) token.Token {
-	switch t.val {
+	switch strings.ToUpper(t.val) {
 	case "^":
 		return token.XOR // we interpret XOR as exponentiation
 	case "+":
@@ -106,21 +128,40 @@ func opToken(t *Token) token.Token {
 		return token.MUL
 	case "/":
 		return token.QUO
+	case "MOD":
+		return token.REM
+	case "=":
+		return token.EQL
+	case "<>":
+		return token.NEQ
+	case "<":
+		return token.LSS
+	case "<=":
+		return token.LEQ
+	case ">":
+		return token.GTR
+	case ">=":
+		return token.GEQ
+	case "AND", "&&", "&":
+		return token.LAND
+	case "OR", "||", "|":
+		return token.LOR
+	case "NOT":
+		return token.NOT
 	}
 	panic(fmt.Errorf("opToken(%#v): illegal token", t))
 }
 
 type exprFn func() (Expr, bool)
 
-func binaryLevelGen(n int, p *parser, ops string) exprFn {
+// binaryLevelGen returns a function parsing left-associative binary
+// expressions whose operators are in ops, and whose operands are
+// expressions of the next higher precedence level.
+func binaryLevelGen(n int, p *parser, ops ...string) exprFn {
 	return func() (lhs Expr, ok bool) {
-		if p.lex.Peek() == nil {
-			return nil, true
-		}
-
 		var next exprFn
 		if n+1 >= len(p.levels) {
-			panic(fmt.Errorf("binaryLevelGen(%d, '%s'): illegal level (max %d)",
+			panic(fmt.Errorf("binaryLevelGen(%d, %v): illegal level (max %d)",
 				n, ops, len(p.levels)))
 		}
 		next = p.levels[n+1]
@@ -130,7 +171,7 @@ func binaryLevelGen(n int, p *parser, ops string) exprFn {
 		}
 
 		var op *Token
-		for op, ok = p.consumeAnyOf(ops); ok; op, ok = p.consumeAnyOf(ops) {
+		for op, ok = p.consumeOp(ops...); ok; op, ok = p.consumeOp(ops...) {
 			var rhs Expr
 			if rhs, ok = next(); !ok {
 				return
@@ -146,7 +187,58 @@ func binaryLevelGen(n int, p *parser, ops string) exprFn {
 	}
 }
 
+// unaryOps are the prefix operators.  They bind less tightly than
+// exponentiation, so -2^2 is -(2^2), but more tightly than any other
+// binary operator.
+var unaryOps = []string{"-", "+", "NOT"}
+
+// factor parses an exponentiation, optionally preceded by unary
+// operators.
 func (p *parser) factor() (x Expr, ok bool) {
+	if op, ok := p.consumeOp(unaryOps...); ok {
+		if x, ok = p.factor(); !ok {
+			return nil, false
+		}
+		return &UnaryExpr{OpPos: op.pos, Op: opToken(op), X: x}, true
+	}
+	return p.power()
+}
+
+// power parses a left-associative chain of exponentiations, so
+// 2^3^2 is (2^3)^2.
+func (p *parser) power() (x Expr, ok bool) {
+	if x, ok = p.primary(); !ok {
+		return nil, false
+	}
+	for op, ok := p.consumeOp("^"); ok; op, ok = p.consumeOp("^") {
+		var y Expr
+		if y, ok = p.exponent(); !ok {
+			return nil, false
+		}
+		x = &BinaryExpr{X: x, OpPos: op.pos, Op: opToken(op), Y: y}
+	}
+	return x, true
+}
+
+// exponent parses the right-hand operand of '^', which may have
+// unary operators of its own, as in 2^-1.
+func (p *parser) exponent() (x Expr, ok bool) {
+	if op, ok := p.consumeOp(unaryOps...); ok {
+		if x, ok = p.exponent(); !ok {
+			return nil, false
+		}
+		return &UnaryExpr{OpPos: op.pos, Op: opToken(op), X: x}, true
+	}
+	return p.primary()
+}
+
+// primary parses parenthesized expressions, IF THEN ELSE
+// expressions, numbers, identifiers and function calls.
+func (p *parser) primary() (x Expr, ok bool) {
+	if tok, ok := p.consumeOp("IF"); ok {
+		return p.ifExpr(tok)
+	}
+
 	var lparen *Token
 	if lparen, ok = p.consumeTok(itemLParen); ok {
 		if x, ok = p.expr(); !ok {
@@ -154,11 +246,11 @@ func (p *parser) factor() (x Expr, ok bool) {
 		}
 		var rparen *Token
 		if rparen, ok = p.consumeTok(itemRParen); !ok {
-			p.errorf(p.lex.Peek(), "expected ')'")
+			p.errorf(p.lex.Peek(), "expected ')', not %s", p.lex.Peek().describe())
 			return nil, false
 		}
 		x = &ParenExpr{lparen.pos, x, rparen.pos}
-		return
+		return p.transpose(x)
 	}
 
 	if x, ok = p.num(); ok {
@@ -168,13 +260,91 @@ func (p *parser) factor() (x Expr, ok bool) {
 		if tok, ok := p.consumeTok(itemLParen); ok {
 			return p.call(x, tok)
 		}
-		return
+		// IndexExpr
+		if tok, ok := p.consumeTok(itemLSquare); ok {
+			if x, ok = p.index(x, tok); !ok {
+				return nil, false
+			}
+		}
+		return p.transpose(x)
 	}
 
-	p.errorf(p.lex.Peek(), "unexpected token")
+	p.errorf(p.lex.Peek(), "unexpected %s", p.lex.Peek().describe())
 	return nil, false
 }
 
+// ifExpr parses the remainder of an IF THEN ELSE expression.  Both
+// branches extend as far to the right as possible, so "IF c THEN a
+// ELSE b + 1" adds 1 only when c is false.
+func (p *parser) ifExpr(ifTok *Token) (x Expr, ok bool) {
+	ie := &IfExpr{If: ifTok.pos}
+
+	if ie.Cond, ok = p.expr(); !ok {
+		return nil, false
+	}
+	p.skipNewlines()
+	if _, ok = p.consumeOp("THEN"); !ok {
+		p.errorf(p.lex.Peek(), "expected THEN, not %s", p.lex.Peek().describe())
+		return nil, false
+	}
+	if ie.Then, ok = p.expr(); !ok {
+		return nil, false
+	}
+	p.skipNewlines()
+	if _, ok = p.consumeOp("ELSE"); !ok {
+		p.errorf(p.lex.Peek(), "expected ELSE, not %s", p.lex.Peek().describe())
+		return nil, false
+	}
+	if ie.Else, ok = p.expr(); !ok {
+		return nil, false
+	}
+	return ie, true
+}
+
+// index parses the subscripts of an array reference.  Each subscript
+// is either an expression, which includes dimension and element
+// names, or a wildcard.
+func (p *parser) index(x Expr, lsquare *Token) (Expr, bool) {
+	ie := &IndexExpr{X: x, Lbrack: lsquare.pos}
+	for {
+		var idx Expr
+		if star, ok := p.consumeOp("*"); ok {
+			w := &WildcardExpr{Star: star.pos}
+			if _, ok := p.consumeOp(":"); ok {
+				dim, ok := p.ident()
+				if !ok {
+					p.errorf(p.lex.Peek(), "expected dimension name after '*:'")
+					return nil, false
+				}
+				w.Dim = dim.(*Ident)
+			}
+			idx = w
+		} else if idx, ok = p.expr(); !ok {
+			return nil, false
+		}
+		ie.Indices = append(ie.Indices, idx)
+
+		if _, ok := p.consumeOp(","); ok {
+			continue
+		}
+		if tok, ok := p.consumeTok(itemRSquare); ok {
+			ie.Rbrack = tok.pos
+			return ie, true
+		}
+		p.errorf(p.lex.Peek(), "index: expected ',' or ']', not %s", p.lex.Peek().describe())
+		return nil, false
+	}
+}
+
+// transpose parses any number of postfix transposition operators
+// following x.
+func (p *parser) transpose(x Expr) (Expr, bool) {
+	for tok, ok := p.consumeOp("'"); ok; tok, ok = p.consumeOp("'") {
+		x = &TransposeExpr{X: x, Quote: tok.pos}
+	}
+	return x, true
+}
+
 func (p *parser) call(fun Expr, lparen *Token) (x Expr, ok bool) {
 	ce := &CallExpr{Fun: fun, Lparen: lparen.pos}
 	x = ce
@@ -188,25 +358,28 @@ func (p *parser) call(fun Expr, lparen *Token) (x Expr, ok bool) {
 	for {
 		var arg Expr
 		if arg, ok = p.expr(); !ok {
-			p.errorf(p.lex.Peek(), "call: expected expr arg, not %#v", p.lex.Peek())
 			return
 		}
 		ce.Args = append(ce.Args, arg)
-		if _, ok = p.consumeAnyOf(","); ok {
+		if _, ok = p.consumeOp(","); ok {
 			continue
 		}
 		if tok, ok = p.consumeTok(itemRParen); ok {
 			ce.Rparen = tok.pos
 			break
 		}
-		p.errorf(p.lex.Peek(), "call: expected ',' or ')', not %#v", p.lex.Peek())
+		p.errorf(p.lex.Peek(), "call: expected ',' or ')', not %s", p.lex.Peek().describe())
 		return nil, false
 	}
 	return
 }
 
+// ident parses a name, which may be quoted, as in "birth rate", to
+// include characters that can't otherwise be part of a name or to
+// use a keyword as a name.
 func (p *parser) ident() (Expr, bool) {
-	if la := p.lex.Peek(); la != nil && la.kind == itemIdentifier {
+	la := p.lex.Peek()
+	if la != nil && (la.kind == itemIdentifier && !isKeyword(la.val) || la.kind == itemLiteral) {
 		t := p.lex.Token()
 		return &Ident{t.pos, t.val}, true
 	}
@@ -221,18 +394,39 @@ func (p *parser) num() (Expr, bool) {
 	return nil, false
 }
 
-func (p *parser) consumeAnyOf(ops string) (*Token, bool) {
+// consumeOp consumes the next token if it is one of the given
+// operators.  Keyword operators, like AND, match identifiers
+// case-insensitively.
+func (p *parser) consumeOp(ops ...string) (*Token, bool) {
 	la := p.lex.Peek()
-	if la == nil || la.kind != itemOperator {
+	if la == nil {
 		return nil, false
 	}
-	op, _ := utf8.DecodeRuneInString(la.val)
-	if op != utf8.RuneError && strings.IndexRune(ops, op) > -1 {
-		return p.lex.Token(), true
+	switch {
+	case la.kind == itemOperator:
+		for _, op := range ops {
+			if la.val == op {
+				return p.lex.Token(), true
+			}
+		}
+	case la.kind == itemIdentifier && isKeyword(la.val):
+		for _, op := range ops {
+			if strings.EqualFold(la.val, op) {
+				return p.lex.Token(), true
+			}
+		}
 	}
 	return nil, false
 }
 
+// skipNewlines consumes semicolons the lexer inserted at the end of
+// a line, for use where an equation is known to continue.
+func (p *parser) skipNewlines() {
+	for la := p.lex.Peek(); la != nil && la.kind == itemSemi && la.val == "\n"; la = p.lex.Peek() {
+		p.lex.Token()
+	}
+}
+
 func (p *parser) consumeTok(ty itemType) (*Token, bool) {
 	la := p.lex.Peek()
 	if la == nil || la.kind != ty {
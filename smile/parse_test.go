@@ -0,0 +1,386 @@
+// Copyright 2013 Bobby Powers. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package smile
+
+import (
+	"fmt"
+	"go/token"
+	"strings"
+	"testing"
+)
+
+// sexpr returns a compact, fully parenthesized representation of x,
+// for comparing the structure of parsed equations.
+func sexpr(x Expr) string {
+	switch x := x.(type) {
+	case *Ident:
+		return x.Name
+	case *BasicLit:
+		return x.Value
+	case *ParenExpr:
+		return fmt.Sprintf("(paren %s)", sexpr(x.X))
+	case *UnaryExpr:
+		return fmt.Sprintf("(%s %s)", x.Op, sexpr(x.X))
+	case *BinaryExpr:
+		return fmt.Sprintf("(%s %s %s)", x.Op, sexpr(x.X), sexpr(x.Y))
+	case *IfExpr:
+		return fmt.Sprintf("(if %s %s %s)", sexpr(x.Cond), sexpr(x.Then), sexpr(x.Else))
+	case *IndexExpr:
+		args := []string{sexpr(x.X)}
+		for _, i := range x.Indices {
+			args = append(args, sexpr(i))
+		}
+		return fmt.Sprintf("(index %s)", strings.Join(args, " "))
+	case *WildcardExpr:
+		if x.Dim != nil {
+			return "*:" + x.Dim.Name
+		}
+		return "*"
+	case *TransposeExpr:
+		return fmt.Sprintf("(transpose %s)", sexpr(x.X))
+	case *CallExpr:
+		args := make([]string, 0, len(x.Args)+1)
+		args = append(args, sexpr(x.Fun))
+		for _, a := range x.Args {
+			args = append(args, sexpr(a))
+		}
+		return fmt.Sprintf("(call %s)", strings.Join(args, " "))
+	}
+	return fmt.Sprintf("<%T>", x)
+}
+
+type parseCase struct {
+	eqn, expected string
+}
+
+func testParse(t *testing.T, cases []parseCase) {
+	for _, c := range cases {
+		x, err := Parse("test", c.eqn)
+		if err != nil {
+			t.Errorf("Parse('%s'): %s", c.eqn, err)
+			continue
+		}
+		if s := sexpr(x); s != c.expected {
+			t.Errorf("Parse('%s'): expected %s, got %s", c.eqn, c.expected, s)
+		}
+	}
+}
+
+func TestParseArithmetic(t *testing.T) {
+	testParse(t, []parseCase{
+		{"a", "a"},
+		{"1e3", "1e3"},
+		{"a + b * c", "(+ a (* b c))"},
+		{"a * b + c", "(+ (* a b) c)"},
+		{"a - b - c", "(- (- a b) c)"},
+		{"a / b ^ c", "(/ a (^ b c))"},
+		{"(a + b) * c", "(* (paren (+ a b)) c)"},
+		{"a MOD b + c", "(+ (% a b) c)"},
+		{"a mod b * c", "(* (% a b) c)"},
+		{"f(a, b + 1)", "(call f a (+ b 1))"},
+	})
+}
+
+func TestParseComparison(t *testing.T) {
+	testParse(t, []parseCase{
+		{"a > b", "(> a b)"},
+		{"a >= b", "(>= a b)"},
+		{"a < b", "(< a b)"},
+		{"a <= b", "(<= a b)"},
+		{"a = b", "(== a b)"},
+		{"a <> b", "(!= a b)"},
+		{"a + 1 > b * 2", "(> (+ a 1) (* b 2))"},
+		{"a < b = c > d", "(== (< a b) (> c d))"},
+	})
+}
+
+func TestParseLogical(t *testing.T) {
+	testParse(t, []parseCase{
+		{"a AND b", "(&& a b)"},
+		{"a and b or c", "(|| (&& a b) c)"},
+		{"a OR b AND c", "(|| a (&& b c))"},
+		{"a & b | c", "(|| (&& a b) c)"},
+		{"a && b || c", "(|| (&& a b) c)"},
+		{"NOT a", "(! a)"},
+		{"not a AND b", "(&& (! a) b)"},
+		{"NOT NOT a", "(! (! a))"},
+		{"a > 1 AND b < 2", "(&& (> a 1) (< b 2))"},
+		{"a > 1 AND\nb < 2", "(&& (> a 1) (< b 2))"},
+	})
+}
+
+func TestParseUnary(t *testing.T) {
+	testParse(t, []parseCase{
+		{"-x", "(- x)"},
+		{"+x", "(+ x)"},
+		{"2 * -3", "(* 2 (- 3))"},
+		{"a - -b", "(- a (- b))"},
+		{"a--b", "(- a (- b))"},
+		{"--a", "(- (- a))"},
+		{"-a + b", "(+ (- a) b)"},
+		{"-a * b", "(* (- a) b)"},
+		{"-2^2", "(- (^ 2 2))"},
+		{"2^-2", "(^ 2 (- 2))"},
+		{"2^3^2", "(^ (^ 2 3) 2)"},
+		{"-2^-3^2", "(- (^ (^ 2 (- 3)) 2))"},
+		{"a * -b ^ 2", "(* a (- (^ b 2)))"},
+		{"(-2)^2", "(^ (paren (- 2)) 2)"},
+		{"NOT -a", "(! (- a))"},
+		{"-f(x)", "(- (call f x))"},
+		{"f(-x, +y)", "(call f (- x) (+ y))"},
+		{"-IF a THEN 1 ELSE 2", "(- (if a 1 2))"},
+		{"a > -1", "(> a (- 1))"},
+		{"1e-3 - -1E+3", "(- 1e-3 (- 1E+3))"},
+	})
+}
+
+func TestUnaryPos(t *testing.T) {
+	x, err := Parse("test", "a * -b")
+	if err != nil {
+		t.Fatalf("Parse: %s", err)
+	}
+	u := x.(*BinaryExpr).Y.(*UnaryExpr)
+	if u.Pos() != 5 || u.End() != 7 {
+		t.Errorf("expected -b to span [5, 7), got [%d, %d)", u.Pos(), u.End())
+	}
+}
+
+func TestParseIf(t *testing.T) {
+	testParse(t, []parseCase{
+		{"IF a > b THEN a ELSE b", "(if (> a b) a b)"},
+		{"if a then 1 else 2", "(if a 1 2)"},
+		{"IF a THEN b ELSE c + 1", "(if a b (+ c 1))"},
+		{"1 + (IF a THEN b ELSE c)", "(+ 1 (paren (if a b c)))"},
+		{"IF a THEN IF b THEN 1 ELSE 2 ELSE 3", "(if a (if b 1 2) 3)"},
+		{"IF a THEN 1 ELSE IF b THEN 2 ELSE 3", "(if a 1 (if b 2 3))"},
+		{"IF a AND NOT b THEN\n\t1\nELSE\n\t0", "(if (&& a (! b)) 1 0)"},
+		{"f(IF a THEN 1 ELSE 2, 3)", "(call f (if a 1 2) 3)"},
+	})
+}
+
+func TestIfPos(t *testing.T) {
+	const eqn = "IF a THEN b ELSE c"
+	x, err := Parse("test", eqn)
+	if err != nil {
+		t.Fatalf("Parse: %s", err)
+	}
+	ie, ok := x.(*IfExpr)
+	if !ok {
+		t.Fatalf("expected *IfExpr, got %T", x)
+	}
+	// positions are 1-based offsets into the equation
+	if ie.Pos() != 1 {
+		t.Errorf("Pos: expected 1, got %d", ie.Pos())
+	}
+	if ie.End() != ie.Else.End() {
+		t.Errorf("End: expected %d, got %d", ie.Else.End(), ie.End())
+	}
+
+	var idents []string
+	Inspect(x, func(n Node) bool {
+		if id, ok := n.(*Ident); ok {
+			idents = append(idents, id.Name)
+		}
+		return true
+	})
+	if strings.Join(idents, ",") != "a,b,c" {
+		t.Errorf("Inspect: expected idents a,b,c, got %v", idents)
+	}
+}
+
+func TestParseIndex(t *testing.T) {
+	testParse(t, []parseCase{
+		{"pop[1]", "(index pop 1)"},
+		{"pop[region, age]", "(index pop region age)"},
+		{"pop[north, 3]", "(index pop north 3)"},
+		{"pop[i + 1, *]", "(index pop (+ i 1) *)"},
+		{"pop[*:region, age]", "(index pop *:region age)"},
+		{"SUM(pop[region, *])", "(call SUM (index pop region *))"},
+		{"pop[1] * 2", "(* (index pop 1) 2)"},
+		{"-pop[1]^2", "(- (^ (index pop 1) 2))"},
+		{"pop[m[1], 2]", "(index pop (index m 1) 2)"},
+		{"m'", "(transpose m)"},
+		{"m''", "(transpose (transpose m))"},
+		{"m[*, 1]' * 2", "(* (transpose (index m * 1)) 2)"},
+		{"(a + b)'", "(transpose (paren (+ a b)))"},
+		{"m'\n", "(transpose m)"},
+		// apostrophes within names aren't transposes
+		{"farmer's_land * 2", "(* farmer's_land 2)"},
+		{`"birth rate" * "if"`, "(* birth rate if)"},
+		{"farmer's_land'", "(transpose farmer's_land)"},
+		{"SUM(o'neill[*])", "(call SUM (index o'neill *))"},
+	})
+}
+
+func TestIndexPos(t *testing.T) {
+	x, err := Parse("test", "pop[*, 2]")
+	if err != nil {
+		t.Fatalf("Parse: %s", err)
+	}
+	ie := x.(*IndexExpr)
+	if ie.Pos() != 1 || ie.Lbrack != 4 || ie.Rbrack != 9 || ie.End() != 10 {
+		t.Errorf("unexpected positions: pos %d lbrack %d rbrack %d end %d",
+			ie.Pos(), ie.Lbrack, ie.Rbrack, ie.End())
+	}
+	if w := ie.Indices[0].(*WildcardExpr); w.Pos() != 5 || w.End() != 6 {
+		t.Errorf("unexpected wildcard span [%d, %d)", w.Pos(), w.End())
+	}
+
+	var n int
+	Inspect(x, func(node Node) bool {
+		if _, ok := node.(*WildcardExpr); ok {
+			n++
+		}
+		return true
+	})
+	if n != 1 {
+		t.Errorf("Inspect: expected to visit 1 wildcard, not %d", n)
+	}
+}
+
+// unknownNode is a Node that Walk doesn't know.
+type unknownNode struct{}
+
+func (unknownNode) Pos() token.Pos { return 0 }
+func (unknownNode) End() token.Pos { return 0 }
+func (unknownNode) exprNode()      {}
+
+func TestWalkUnknownNode(t *testing.T) {
+	defer func() {
+		if r := recover(); r == nil || !strings.Contains(fmt.Sprint(r), "unexpected node type") {
+			t.Errorf("expected a panic about an unexpected node, got %v", r)
+		}
+	}()
+	x := &BinaryExpr{X: NewIdent("a"), Op: token.ADD, Y: &ParenExpr{X: unknownNode{}}}
+	Inspect(x, func(Node) bool { return true })
+}
+
+func TestParseErrors(t *testing.T) {
+	for _, eqn := range []string{
+		"IF a THEN b",
+		"IF a ELSE b",
+		"IF THEN a ELSE b",
+		"a + IF",
+		"-",
+		"2 ^ -",
+		"a * - ",
+		"pop[]",
+		"pop[1,]",
+		"pop[1",
+		"pop[*:]",
+		"pop[1 2]",
+		"a +",
+		"a AND",
+		"NOT",
+		"a b",
+		"and",
+	} {
+		if x, err := Parse("test", eqn); err == nil {
+			t.Errorf("Parse('%s'): expected error, got %s", eqn, sexpr(x))
+		}
+	}
+}
+
+func TestErrorPositions(t *testing.T) {
+	cases := []struct {
+		eqn       string
+		line, col int
+		msg       string
+	}{
+		{`a + "unterminated`, 1, 5, "unterminated literal"},
+		{"1e+", 1, 1, "malformed number"},
+		{"a +\nb c", 2, 3, "'c'"},
+		{"a \x00 b", 1, 3, "unrecognized char"},
+		{"(a + b", 1, 7, "expected ')'"},
+		{"max(a b)", 1, 7, "call"},
+		{"IF a THEN b", 1, 12, "expected ELSE"},
+		{"a; b", 1, 4, "after end of equation"},
+	}
+	for _, c := range cases {
+		_, err := Parse("test", c.eqn)
+		list, ok := err.(ErrorList)
+		if !ok || len(list) == 0 {
+			t.Errorf("Parse(%q): expected ErrorList, got %#v", c.eqn, err)
+			continue
+		}
+		e := list[0]
+		if e.Pos.Line != c.line || e.Pos.Column != c.col {
+			t.Errorf("Parse(%q): expected error at %d:%d, got %s", c.eqn, c.line, c.col, e)
+		}
+		if !strings.Contains(e.Msg, c.msg) {
+			t.Errorf("Parse(%q): expected message containing '%s', got '%s'", c.eqn, c.msg, e.Msg)
+		}
+	}
+}
+
+func TestParseExprPositions(t *testing.T) {
+	fset := token.NewFileSet()
+	if _, err := ParseExpr(fset, "first", "a + b"); err != nil {
+		t.Fatalf("ParseExpr: %s", err)
+	}
+	x, err := ParseExpr(fset, "second", "c +\n    d")
+	if err != nil {
+		t.Fatalf("ParseExpr: %s", err)
+	}
+	y := x.(*BinaryExpr).Y
+	if pos := fset.Position(y.Pos()); pos.Filename != "second" || pos.Line != 2 || pos.Column != 5 {
+		t.Errorf("expected d at second:2:5, got %s", pos)
+	}
+}
+
+func TestLexerErrorSnippet(t *testing.T) {
+	cases := []struct {
+		eqn      string
+		offset   int
+		expected string
+	}{
+		{"a + $", 4, "test:1:5: error: bad\na + $\n    ^"},
+		{"a +\n\tb $", 7, "test:2:4: error: bad\n        b $\n          ^"},
+	}
+	for _, c := range cases {
+		fset := token.NewFileSet()
+		f := fset.AddFile("test", fset.Base(), len(c.eqn))
+		l := newLexer(c.eqn, f, nil)
+		for tok := l.Token(); tok.kind != itemEOF; tok = l.Token() {
+		}
+		if s := l.Error(f.Position(f.Pos(c.offset)), "bad"); s != c.expected {
+			t.Errorf("expected\n%s\ngot\n%s", c.expected, s)
+		}
+	}
+}
+
+func FuzzParse(f *testing.F) {
+	for _, seed := range []string{
+		"a + b * c",
+		"IF a > 1 THEN b ELSE -c ^ 2",
+		"pop[north, *:age]'",
+		"MAX(a, 2) MOD 3",
+		`"quoted name" + {comment} 1.5e3`,
+		"a +\nb",
+		"1e+",
+		`"unterminated`,
+	} {
+		f.Add(seed)
+	}
+	f.Fuzz(func(t *testing.T, eqn string) {
+		fset := token.NewFileSet()
+		x, err := ParseExpr(fset, "fuzz", eqn)
+		if err == nil {
+			if x == nil {
+				t.Fatalf("ParseExpr(%q): nil Expr without an error", eqn)
+			}
+			return
+		}
+		list, ok := err.(ErrorList)
+		if !ok || len(list) == 0 {
+			t.Fatalf("ParseExpr(%q): expected ErrorList, got %#v", eqn, err)
+		}
+		for _, e := range list {
+			if e.Pos.Offset < 0 || e.Pos.Offset > len(eqn)+1 {
+				t.Errorf("ParseExpr(%q): error outside input: %s", eqn, e)
+			}
+		}
+	})
+}
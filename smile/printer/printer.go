@@ -0,0 +1,239 @@
+// Copyright 2013 Bobby Powers. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Package printer formats smile expressions as XMILE equations.
+//
+// Output is canonical: binary operators other than '^' are surrounded
+// by single spaces, keywords are upper case, and parentheses appear
+// only where operator precedence requires them, regardless of any
+// ParenExprs in the input.  Parsing the output yields an expression
+// equal to the input, apart from positions and parentheses.
+package printer
+
+import (
+	"bytes"
+	"fmt"
+	"go/token"
+	"io"
+	"strings"
+
+	"github.com/bpowers/go-xmile/smile"
+)
+
+// precedence levels, from loosest to tightest binding.  These
+// mirror the levels in smile's parser.
+const (
+	precLowest = iota
+	precOr
+	precAnd
+	precEquality
+	precRelational
+	precAdditive
+	precMultiplicative
+	precUnary
+	precPower
+	precPrimary
+)
+
+var binaryOps = map[token.Token]struct {
+	s    string
+	prec int
+}{
+	token.LOR:  {"OR", precOr},
+	token.LAND: {"AND", precAnd},
+	token.EQL:  {"=", precEquality},
+	token.NEQ:  {"<>", precEquality},
+	token.LSS:  {"<", precRelational},
+	token.LEQ:  {"<=", precRelational},
+	token.GTR:  {">", precRelational},
+	token.GEQ:  {">=", precRelational},
+	token.ADD:  {"+", precAdditive},
+	token.SUB:  {"-", precAdditive},
+	token.MUL:  {"*", precMultiplicative},
+	token.QUO:  {"/", precMultiplicative},
+	token.REM:  {"MOD", precMultiplicative},
+	token.XOR:  {"^", precPower},
+}
+
+var unaryOps = map[token.Token]string{
+	token.ADD: "+",
+	token.SUB: "-",
+	token.NOT: "NOT ",
+}
+
+// Fprint writes the canonical equation text for x to w.
+func Fprint(w io.Writer, x smile.Expr) error {
+	var p printer
+	p.expr(x, precLowest)
+	if p.err != nil {
+		return p.err
+	}
+	_, err := w.Write(p.buf.Bytes())
+	return err
+}
+
+// Sprint returns the canonical equation text for x.
+func Sprint(x smile.Expr) (string, error) {
+	var buf bytes.Buffer
+	if err := Fprint(&buf, x); err != nil {
+		return "", err
+	}
+	return buf.String(), nil
+}
+
+type printer struct {
+	buf bytes.Buffer
+	err error
+}
+
+// unparen strips any ParenExprs wrapping x.
+func unparen(x smile.Expr) smile.Expr {
+	for {
+		p, ok := x.(*smile.ParenExpr)
+		if !ok {
+			return x
+		}
+		x = p.X
+	}
+}
+
+// name prints an identifier, quoting it if it wouldn't otherwise
+// parse as the same name, as with names containing spaces or names
+// that are keywords.
+func (p *printer) name(s string) {
+	if x, err := smile.Parse("name", s); err == nil {
+		if id, ok := x.(*smile.Ident); ok && id.Name == s {
+			p.buf.WriteString(s)
+			return
+		}
+	}
+	if s == "" || strings.Contains(s, `"`) {
+		p.errorf("can't print the name %q", s)
+		return
+	}
+	p.buf.WriteString(`"` + s + `"`)
+}
+
+// prec returns the precedence of x's outermost operator.
+func prec(x smile.Expr) int {
+	switch x := unparen(x).(type) {
+	case *smile.BinaryExpr:
+		if op, ok := binaryOps[x.Op]; ok {
+			return op.prec
+		}
+	case *smile.UnaryExpr:
+		return precUnary
+	case *smile.IfExpr:
+		// the ELSE branch extends as far right as possible, so
+		// an IF must be parenthesized wherever it is an operand.
+		return precLowest
+	}
+	return precPrimary
+}
+
+// expr prints x, parenthesizing it if its precedence is below min.
+func (p *printer) expr(x smile.Expr, min int) {
+	x = unparen(x)
+	if prec(x) < min {
+		p.buf.WriteByte('(')
+		defer p.buf.WriteByte(')')
+	}
+
+	switch x := x.(type) {
+	case *smile.Ident:
+		p.name(x.Name)
+	case *smile.BasicLit:
+		p.buf.WriteString(x.Value)
+	case *smile.BinaryExpr:
+		op, ok := binaryOps[x.Op]
+		if !ok {
+			p.errorf("unsupported binary operator %s", x.Op)
+			return
+		}
+		if x.Op == token.XOR {
+			// the base of an exponentiation is a primary
+			// expression or another exponentiation, and the
+			// exponent is a primary expression with optional
+			// unary operators.
+			p.expr(x.X, precPower)
+			p.buf.WriteString(op.s)
+			p.exponent(x.Y)
+			return
+		}
+		// all other binary operators are left-associative
+		p.expr(x.X, op.prec)
+		p.buf.WriteString(" " + op.s + " ")
+		p.expr(x.Y, op.prec+1)
+	case *smile.UnaryExpr:
+		if !p.unaryOp(x) {
+			return
+		}
+		p.expr(x.X, precUnary)
+	case *smile.IfExpr:
+		p.buf.WriteString("IF ")
+		p.expr(x.Cond, precLowest)
+		p.buf.WriteString(" THEN ")
+		p.expr(x.Then, precLowest)
+		p.buf.WriteString(" ELSE ")
+		p.expr(x.Else, precLowest)
+	case *smile.CallExpr:
+		p.expr(x.Fun, precPrimary)
+		p.buf.WriteByte('(')
+		p.list(x.Args)
+		p.buf.WriteByte(')')
+	case *smile.IndexExpr:
+		p.expr(x.X, precPrimary)
+		p.buf.WriteByte('[')
+		p.list(x.Indices)
+		p.buf.WriteByte(']')
+	case *smile.WildcardExpr:
+		p.buf.WriteByte('*')
+		if x.Dim != nil {
+			p.buf.WriteByte(':')
+			p.name(x.Dim.Name)
+		}
+	case *smile.TransposeExpr:
+		p.expr(x.X, precPrimary)
+		p.buf.WriteByte('\'')
+	default:
+		p.errorf("unsupported expression %T", x)
+	}
+}
+
+// exponent prints the right-hand operand of '^'.
+func (p *printer) exponent(x smile.Expr) {
+	x = unparen(x)
+	if u, ok := x.(*smile.UnaryExpr); ok {
+		if p.unaryOp(u) {
+			p.exponent(u.X)
+		}
+		return
+	}
+	p.expr(x, precPrimary)
+}
+
+func (p *printer) unaryOp(x *smile.UnaryExpr) bool {
+	op, ok := unaryOps[x.Op]
+	if !ok {
+		p.errorf("unsupported unary operator %s", x.Op)
+		return false
+	}
+	p.buf.WriteString(op)
+	return true
+}
+
+func (p *printer) list(xs []smile.Expr) {
+	for i, x := range xs {
+		if i > 0 {
+			p.buf.WriteString(", ")
+		}
+		p.expr(x, precLowest)
+	}
+}
+
+func (p *printer) errorf(format string, args ...interface{}) {
+	if p.err == nil {
+		p.err = fmt.Errorf(format, args...)
+	}
+}
@@ -0,0 +1,214 @@
+// Copyright 2013 Bobby Powers. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package printer
+
+import (
+	"go/token"
+	"math/rand"
+	"reflect"
+	"testing"
+
+	"github.com/bpowers/go-xmile/smile"
+)
+
+// strip returns a copy of x without positions or ParenExprs, so
+// that expressions can be compared structurally.
+func strip(x smile.Expr) smile.Expr {
+	switch x := x.(type) {
+	case *smile.ParenExpr:
+		return strip(x.X)
+	case *smile.Ident:
+		return &smile.Ident{Name: x.Name}
+	case *smile.BasicLit:
+		return &smile.BasicLit{Kind: x.Kind, Value: x.Value}
+	case *smile.UnaryExpr:
+		return &smile.UnaryExpr{Op: x.Op, X: strip(x.X)}
+	case *smile.BinaryExpr:
+		return &smile.BinaryExpr{X: strip(x.X), Op: x.Op, Y: strip(x.Y)}
+	case *smile.IfExpr:
+		return &smile.IfExpr{Cond: strip(x.Cond), Then: strip(x.Then), Else: strip(x.Else)}
+	case *smile.CallExpr:
+		return &smile.CallExpr{Fun: strip(x.Fun), Args: stripList(x.Args)}
+	case *smile.IndexExpr:
+		return &smile.IndexExpr{X: strip(x.X), Indices: stripList(x.Indices)}
+	case *smile.WildcardExpr:
+		w := &smile.WildcardExpr{}
+		if x.Dim != nil {
+			w.Dim = &smile.Ident{Name: x.Dim.Name}
+		}
+		return w
+	case *smile.TransposeExpr:
+		return &smile.TransposeExpr{X: strip(x.X)}
+	}
+	return x
+}
+
+func stripList(xs []smile.Expr) []smile.Expr {
+	if xs == nil {
+		return nil
+	}
+	out := make([]smile.Expr, len(xs))
+	for i, x := range xs {
+		out[i] = strip(x)
+	}
+	return out
+}
+
+// roundTrip checks that printing x and parsing the result gives back
+// x, and returns the printed form.
+func roundTrip(t *testing.T, x smile.Expr) string {
+	s, err := Sprint(x)
+	if err != nil {
+		t.Fatalf("Sprint: %s", err)
+	}
+	y, err := smile.Parse("test", s)
+	if err != nil {
+		t.Fatalf("Parse('%s'): %s", s, err)
+	}
+	if !reflect.DeepEqual(strip(x), strip(y)) {
+		t.Errorf("Parse(Sprint(x)) != x for '%s'", s)
+	}
+	return s
+}
+
+func TestCanonical(t *testing.T) {
+	cases := []struct {
+		in, out string
+	}{
+		{"a+b*c", "a + b * c"},
+		{"(a+b)*c", "(a + b) * c"},
+		{"((a))", "a"},
+		{"a-(b-c)", "a - (b - c)"},
+		{"(a-b)-c", "a - b - c"},
+		{"a/(b*c)", "a / (b * c)"},
+		{"a mod b", "a MOD b"},
+		{"2 ^ 3", "2^3"},
+		{"(2^3)^2", "2^3^2"},
+		{"2^(3^2)", "2^(3^2)"},
+		{"-2^2", "-2^2"},
+		{"(-2)^2", "(-2)^2"},
+		{"2^-1", "2^-1"},
+		{"2^(-(1+1))", "2^-(1 + 1)"},
+		{"-(a+b)", "-(a + b)"},
+		{"- -a", "--a"},
+		{"a - (-b)", "a - -b"},
+		{"+a", "+a"},
+		{"not a and b", "NOT a AND b"},
+		{"NOT (a AND b)", "NOT (a AND b)"},
+		{"a & b | c", "a AND b OR c"},
+		{"a or (b and c)", "a OR b AND c"},
+		{"(a or b) and c", "(a OR b) AND c"},
+		{"a>1=b<=2", "a > 1 = b <= 2"},
+		{"a <> b", "a <> b"},
+		{"if a>b then a else b", "IF a > b THEN a ELSE b"},
+		{"(IF a THEN b ELSE c) + 1", "(IF a THEN b ELSE c) + 1"},
+		{"1 + (IF a THEN b ELSE c)", "1 + (IF a THEN b ELSE c)"},
+		{"IF a THEN (b + 1) ELSE (c)", "IF a THEN b + 1 ELSE c"},
+		{"MAX(a,(b))", "MAX(a, b)"},
+		{"pop[region,*]", "pop[region, *]"},
+		{"pop[*:region, (i+1)]", "pop[*:region, i + 1]"},
+		{"m[*,1]'", "m[*, 1]'"},
+		{"(a+b)'", "(a + b)'"},
+		{"hare__density/area", "hare__density / area"},
+	}
+	for _, c := range cases {
+		x, err := smile.Parse("test", c.in)
+		if err != nil {
+			t.Fatalf("Parse('%s'): %s", c.in, err)
+		}
+		if out := roundTrip(t, x); out != c.out {
+			t.Errorf("'%s': expected '%s', got '%s'", c.in, c.out, out)
+		}
+	}
+}
+
+func TestSynthesized(t *testing.T) {
+	id := smile.NewIdent
+	bin := func(x smile.Expr, op token.Token, y smile.Expr) smile.Expr {
+		return &smile.BinaryExpr{X: x, Op: op, Y: y}
+	}
+	neg := func(x smile.Expr) smile.Expr {
+		return &smile.UnaryExpr{Op: token.SUB, X: x}
+	}
+	cases := []struct {
+		x   smile.Expr
+		out string
+	}{
+		{bin(bin(id("a"), token.ADD, id("b")), token.MUL, id("c")), "(a + b) * c"},
+		{bin(id("a"), token.SUB, bin(id("b"), token.ADD, id("c"))), "a - (b + c)"},
+		{bin(neg(id("a")), token.XOR, id("b")), "(-a)^b"},
+		{neg(bin(id("a"), token.XOR, id("b"))), "-a^b"},
+		{bin(id("a"), token.XOR, neg(bin(id("b"), token.XOR, id("c")))), "a^-(b^c)"},
+		{bin(&smile.IfExpr{Cond: id("a"), Then: id("b"), Else: id("c")}, token.ADD, id("d")),
+			"(IF a THEN b ELSE c) + d"},
+		{&smile.TransposeExpr{X: bin(id("a"), token.MUL, id("b"))}, "(a * b)'"},
+		// names that wouldn't parse as themselves are quoted
+		{bin(id("birth rate"), token.MUL, id("if")), `"birth rate" * "if"`},
+		{bin(id("o'neill"), token.ADD, id("2x")), `o'neill + "2x"`},
+		{&smile.TransposeExpr{X: id("a'")}, `"a'"'`},
+		{&smile.IndexExpr{X: id("pop"), Indices: []smile.Expr{
+			&smile.WildcardExpr{Dim: id("age group")}}}, `pop[*:"age group"]`},
+	}
+	for _, c := range cases {
+		if out := roundTrip(t, c.x); out != c.out {
+			t.Errorf("expected '%s', got '%s'", c.out, out)
+		}
+	}
+}
+
+func TestUnsupported(t *testing.T) {
+	if _, err := Sprint(&smile.BadExpr{}); err == nil {
+		t.Errorf("expected error printing BadExpr")
+	}
+	bad := &smile.BinaryExpr{X: smile.NewIdent("a"), Op: token.SHL, Y: smile.NewIdent("b")}
+	if _, err := Sprint(bad); err == nil {
+		t.Errorf("expected error printing '<<'")
+	}
+	if _, err := Sprint(smile.NewIdent(`a"b`)); err == nil {
+		t.Errorf("expected error printing a name with a quote")
+	}
+}
+
+var (
+	randBinaryOps = []token.Token{
+		token.LOR, token.LAND, token.EQL, token.NEQ, token.LSS, token.LEQ,
+		token.GTR, token.GEQ, token.ADD, token.SUB, token.MUL, token.QUO,
+		token.REM, token.XOR,
+	}
+	randUnaryOps = []token.Token{token.ADD, token.SUB, token.NOT}
+)
+
+// randExpr returns a random expression with at most depth levels of
+// nesting.
+func randExpr(r *rand.Rand, depth int) smile.Expr {
+	if depth == 0 {
+		if r.Intn(2) == 0 {
+			return smile.NewIdent("x")
+		}
+		return &smile.BasicLit{Kind: token.FLOAT, Value: "2"}
+	}
+	depth--
+	switch r.Intn(7) {
+	case 0, 1, 2:
+		op := randBinaryOps[r.Intn(len(randBinaryOps))]
+		return &smile.BinaryExpr{X: randExpr(r, depth), Op: op, Y: randExpr(r, depth)}
+	case 3:
+		op := randUnaryOps[r.Intn(len(randUnaryOps))]
+		return &smile.UnaryExpr{Op: op, X: randExpr(r, depth)}
+	case 4:
+		return &smile.IfExpr{Cond: randExpr(r, depth), Then: randExpr(r, depth), Else: randExpr(r, depth)}
+	case 5:
+		return &smile.CallExpr{Fun: smile.NewIdent("f"), Args: []smile.Expr{randExpr(r, depth), randExpr(r, depth)}}
+	default:
+		return &smile.ParenExpr{X: randExpr(r, depth)}
+	}
+}
+
+func TestRandomRoundTrip(t *testing.T) {
+	r := rand.New(rand.NewSource(1))
+	for i := 0; i < 2000; i++ {
+		roundTrip(t, randExpr(r, 5))
+	}
+}
@@ -36,7 +36,8 @@ func walkExprList(v Visitor, list []Expr) {
 // v.Visit(node); node must not be nil. If the visitor w returned by
 // v.Visit(node) is not nil, Walk is invoked recursively with visitor
 // w for each of the non-nil children of node, followed by a call of
-// w.Visit(nil).
+// w.Visit(nil).  Walk panics on node types it doesn't know, which
+// Parse never produces.
 //
 func Walk(v Visitor, node Node) {
 	if v = v.Visit(node); v == nil {
@@ -57,7 +58,15 @@ func Walk(v Visitor, node Node) {
 
 	case *IndexExpr:
 		Walk(v, n.X)
-		Walk(v, n.Index)
+		walkExprList(v, n.Indices)
+
+	case *WildcardExpr:
+		if n.Dim != nil {
+			Walk(v, n.Dim)
+		}
+
+	case *TransposeExpr:
+		Walk(v, n.X)
 
 	case *CallExpr:
 		Walk(v, n.Fun)
@@ -70,9 +79,13 @@ func Walk(v Visitor, node Node) {
 		Walk(v, n.X)
 		Walk(v, n.Y)
 
+	case *IfExpr:
+		Walk(v, n.Cond)
+		Walk(v, n.Then)
+		Walk(v, n.Else)
+
 	default:
-		fmt.Printf("ast.Walk: unexpected node type %T", n)
-		panic("ast.Walk")
+		panic(fmt.Sprintf("ast.Walk: unexpected node type %T", n))
 	}
 
 	v.Visit(nil)
@@ -29,11 +29,11 @@ func ExampleNewFile() {
 				Units:    "people",
 			},
 		},
-		Views: []*xmile.View{},
 	}
 
 	f := xmile.NewFile(1, "hello xworld")
 	f.Header.UUID = "7a435517-ce5d-c816-9ec5-b34e44ec4fee"
+	f.Header.Vendor = "XMILE TC"
 	f.Models = append(f.Models, m)
 	f.SimSpec.TimeUnits = "year"
 
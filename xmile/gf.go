@@ -0,0 +1,149 @@
+// Copyright 2013 Bobby Powers. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package xmile
+
+import (
+	"fmt"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+// GFType determines how a graphical function is evaluated between
+// and beyond its points.
+type GFType string
+
+const (
+	// GFContinuous interpolates linearly between points, and
+	// clamps inputs outside the x range to the first or last y
+	// value.
+	GFContinuous GFType = "continuous"
+	// GFExtrapolate interpolates linearly between points, and
+	// extends the first and last segments for inputs outside the
+	// x range.
+	GFExtrapolate GFType = "extrapolate"
+	// GFDiscrete is a step function: each y value holds from its
+	// x value up to the next point's x value.
+	GFDiscrete GFType = "discrete"
+)
+
+// Table is a graphical function whose points have been parsed, ready
+// for evaluation.
+type Table struct {
+	Type GFType
+	X    []float64 // in non-decreasing order
+	Y    []float64
+}
+
+// Table parses the graphical function's points.  If XPoints is empty,
+// the x values are spaced evenly across XScale.
+func (gf *GF) Table() (*Table, error) {
+	t := &Table{Type: gf.Type}
+	if t.Type == "" {
+		t.Type = GFContinuous
+		if gf.Discrete {
+			t.Type = GFDiscrete
+		}
+	}
+	switch t.Type {
+	case GFContinuous, GFExtrapolate, GFDiscrete:
+	default:
+		return nil, fmt.Errorf("unknown gf type '%s'", t.Type)
+	}
+
+	var err error
+	if t.Y, err = parsePoints(gf.YPoints); err != nil {
+		return nil, fmt.Errorf("ypts: %s", err)
+	} else if len(t.Y) == 0 {
+		return nil, fmt.Errorf("gf has no ypts")
+	}
+
+	n := len(t.Y)
+	if strings.TrimSpace(gf.XPoints) != "" {
+		if t.X, err = parsePoints(gf.XPoints); err != nil {
+			return nil, fmt.Errorf("xpts: %s", err)
+		} else if len(t.X) != n {
+			return nil, fmt.Errorf("gf has %d xpts but %d ypts", len(t.X), n)
+		}
+		for i := 1; i < n; i++ {
+			if t.X[i] < t.X[i-1] {
+				return nil, fmt.Errorf("xpts are not in increasing order")
+			}
+		}
+		return t, nil
+	}
+
+	min, max := gf.XScale.Min, gf.XScale.Max
+	if n > 1 && max <= min {
+		return nil, fmt.Errorf("gf without xpts needs an xscale (min %g, max %g)", min, max)
+	}
+	t.X = make([]float64, n)
+	for i := range t.X {
+		t.X[i] = min
+		if n > 1 {
+			t.X[i] += float64(i) * (max - min) / float64(n-1)
+		}
+	}
+	return t, nil
+}
+
+// parsePoints parses a list of numbers separated by commas and/or
+// whitespace.
+func parsePoints(pts string) ([]float64, error) {
+	fields := strings.FieldsFunc(pts, func(r rune) bool {
+		return r == ',' || unicode.IsSpace(r)
+	})
+	vals := make([]float64, len(fields))
+	for i, f := range fields {
+		v, err := strconv.ParseFloat(f, 64)
+		if err != nil {
+			return nil, fmt.Errorf("bad point '%s'", f)
+		}
+		vals[i] = v
+	}
+	return vals, nil
+}
+
+// Lookup evaluates the graphical function at x.
+func (t *Table) Lookup(x float64) float64 {
+	n := len(t.X)
+	if math.IsNaN(x) {
+		return math.NaN()
+	}
+
+	if x <= t.X[0] {
+		if t.Type == GFExtrapolate && n > 1 && x < t.X[0] {
+			return t.interpolate(0, 1, x)
+		}
+		return t.Y[0]
+	} else if x >= t.X[n-1] {
+		if t.Type == GFExtrapolate && n > 1 && x > t.X[n-1] {
+			return t.interpolate(n-2, n-1, x)
+		}
+		return t.Y[n-1]
+	}
+
+	// the first point whose x value is >= x.  Because of the
+	// range checks above, 0 < i < n.
+	i := sort.SearchFloat64s(t.X, x)
+	if t.X[i] == x {
+		return t.Y[i]
+	} else if t.Type == GFDiscrete {
+		return t.Y[i-1]
+	}
+	return t.interpolate(i-1, i, x)
+}
+
+// interpolate returns the value at x of the line through points i and
+// j.
+func (t *Table) interpolate(i, j int, x float64) float64 {
+	dx := t.X[j] - t.X[i]
+	if dx == 0 {
+		return t.Y[j]
+	}
+	return t.Y[i] + (x-t.X[i])*(t.Y[j]-t.Y[i])/dx
+}
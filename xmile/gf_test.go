@@ -0,0 +1,118 @@
+// Copyright 2013 Bobby Powers. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package xmile_test
+
+import (
+	"math"
+	"testing"
+
+	"github.com/bpowers/go-xmile/xmile"
+)
+
+type lookupCase struct {
+	x, y float64
+}
+
+func testTable(t *testing.T, gf *xmile.GF, cases []lookupCase) {
+	table, err := gf.Table()
+	if err != nil {
+		t.Fatalf("gf.Table(): %s", err)
+	}
+	for _, c := range cases {
+		if y := table.Lookup(c.x); math.Abs(y-c.y) > 1e-12 {
+			t.Errorf("%s: Lookup(%g): expected %g, got %g", table.Type, c.x, c.y, y)
+		}
+	}
+}
+
+func TestGFContinuous(t *testing.T) {
+	gf := &xmile.GF{
+		XPoints: "0,1,3",
+		YPoints: "0, 10, 30",
+	}
+	testTable(t, gf, []lookupCase{
+		{-1, 0},
+		{0, 0},
+		{.5, 5},
+		{1, 10},
+		{2.5, 25},
+		{3, 30},
+		{7, 30},
+	})
+}
+
+func TestGFExtrapolate(t *testing.T) {
+	gf := &xmile.GF{
+		Type:    xmile.GFExtrapolate,
+		XPoints: "0,1,2",
+		YPoints: "0,10,40",
+	}
+	testTable(t, gf, []lookupCase{
+		{-1, -10},
+		{.5, 5},
+		{2, 40},
+		{3, 70},
+	})
+}
+
+func TestGFDiscrete(t *testing.T) {
+	for _, gf := range []*xmile.GF{
+		{Discrete: true, XPoints: "0,1,2", YPoints: "5,6,7"},
+		{Type: xmile.GFDiscrete, XPoints: "0,1,2", YPoints: "5,6,7"},
+	} {
+		testTable(t, gf, []lookupCase{
+			{-1, 5},
+			{0, 5},
+			{.99, 5},
+			{1, 6},
+			{1.5, 6},
+			{2, 7},
+			{9, 7},
+		})
+	}
+}
+
+func TestGFTypeOverridesDiscrete(t *testing.T) {
+	gf := &xmile.GF{
+		Type:     xmile.GFContinuous,
+		Discrete: true,
+		XPoints:  "0,1",
+		YPoints:  "0,1",
+	}
+	testTable(t, gf, []lookupCase{{.25, .25}})
+}
+
+func TestGFXScale(t *testing.T) {
+	gf := &xmile.GF{
+		YPoints: "0 4 8",
+		XScale:  xmile.Scale{Min: 10, Max: 20},
+	}
+	table, err := gf.Table()
+	if err != nil {
+		t.Fatalf("gf.Table(): %s", err)
+	}
+	expected := []float64{10, 15, 20}
+	for i, x := range table.X {
+		if x != expected[i] {
+			t.Errorf("X[%d]: expected %g, got %g", i, expected[i], x)
+		}
+	}
+	testTable(t, gf, []lookupCase{{12.5, 2}, {0, 0}})
+}
+
+func TestGFErrors(t *testing.T) {
+	for _, gf := range []*xmile.GF{
+		{YPoints: ""},
+		{YPoints: "1,2", XPoints: "1"},
+		{YPoints: "1,2", XPoints: "2,1"},
+		{YPoints: "1,x"},
+		{YPoints: "1,2"}, // no xpts or xscale
+		{Type: "smooth", YPoints: "1", XPoints: "1"},
+	} {
+		if _, err := gf.Table(); err == nil {
+			t.Errorf("expected error for %#v", gf)
+		}
+	}
+}
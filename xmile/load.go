@@ -0,0 +1,222 @@
+// Copyright 2013 Bobby Powers. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package xmile
+
+import (
+	"bytes"
+	"encoding/xml"
+	"fmt"
+	"io/fs"
+	"path"
+	"strings"
+)
+
+// Load reads the XMILE file at name in fsys, along with every file
+// the modules in it refer to through their Resource, and links them
+// into a single File.  Resources are paths relative to the file that
+// contains the module.  The models of other files are appended to
+// the root file's Models, named with their file's path, and a "#"
+// and their own name unless they are their file's root model.  Their
+// dimensions and macros are added to the root file's, which must not
+// already have different ones of the same name, and their behavior
+// must match the root file's, as these are shared by every model.
+// Every
+// module is then pointed at its model by name, and its Resource is
+// cleared.  Files that refer back to themselves through their
+// modules' resources are an error.
+func Load(fsys fs.FS, name string) (*File, error) {
+	l := &loader{
+		fsys:  fsys,
+		files: make(map[string]*File),
+		roots: make(map[*File]*Model),
+		names: make(map[*Model]string),
+	}
+	return l.load(path.Clean(name))
+}
+
+type loader struct {
+	fsys  fs.FS
+	root  *File
+	files map[string]*File // the files loaded so far, by path
+	roots map[*File]*Model
+	// names holds the models' names within their own file, which
+	// modules refer to.
+	names map[*Model]string
+	stack []string // the paths of the files being loaded
+}
+
+func (l *loader) load(p string) (*File, error) {
+	for i, q := range l.stack {
+		if q == p {
+			cycle := append(l.stack[i:len(l.stack):len(l.stack)], p)
+			return nil, fmt.Errorf("module resources form a cycle: %s", strings.Join(cycle, " -> "))
+		}
+	}
+	if f, ok := l.files[p]; ok {
+		return f, nil
+	}
+
+	contents, err := fs.ReadFile(l.fsys, p)
+	if err != nil {
+		return nil, err
+	}
+	f := new(File)
+	if err := xml.Unmarshal(contents, f); err != nil {
+		return nil, fmt.Errorf("%s: xml.Unmarshal: %s", p, err)
+	}
+	isRoot := l.root == nil
+	if isRoot {
+		l.root = f
+	} else if err := l.merge(p, f); err != nil {
+		return nil, err
+	}
+	l.stack = append(l.stack, p)
+	defer func() { l.stack = l.stack[:len(l.stack)-1] }()
+
+	l.roots[f] = rootModel(f)
+	for _, m := range f.Models {
+		l.names[m] = m.Name
+		if isRoot {
+			continue
+		}
+		if m == l.roots[f] {
+			m.Name = p
+		} else {
+			m.Name = p + "#" + m.Name
+		}
+		l.root.Models = append(l.root.Models, m)
+	}
+	l.files[p] = f
+
+	for _, m := range f.Models {
+		for _, v := range m.Variables {
+			if v.XMLName.Local != "module" {
+				continue
+			}
+			if v.Resource == "" {
+				if isRoot {
+					continue
+				}
+				target := v.Model
+				if target == "" {
+					target = v.Name
+				}
+				if m := l.model(f, target); m != nil {
+					v.Model = m.Name
+				}
+				continue
+			}
+
+			res, frag := v.Resource, ""
+			if i := strings.IndexByte(res, '#'); i >= 0 {
+				res, frag = res[:i], res[i+1:]
+			}
+			rp := path.Join(path.Dir(p), res)
+			if !fs.ValidPath(rp) {
+				return nil, fmt.Errorf("%s: module %s: bad resource '%s'", p, v.Name, v.Resource)
+			}
+			rf, err := l.load(rp)
+			if err != nil {
+				return nil, err
+			}
+			m := l.roots[rf]
+			if frag != "" {
+				m = l.model(rf, frag)
+			}
+			if m == nil {
+				return nil, fmt.Errorf("%s: module %s: no model in '%s'", p, v.Name, v.Resource)
+			}
+			v.Model, v.Resource = m.Name, ""
+		}
+	}
+	return f, nil
+}
+
+// merge adds the dimensions and macros of f, a file other than the
+// root, to the root file.
+func (l *loader) merge(p string, f *File) error {
+	if nonNegative(f.Behavior) != nonNegative(l.root.Behavior) {
+		return fmt.Errorf("%s: behavior differs from '%s'", p, l.stack[0])
+	}
+	for _, d := range f.Dimensions {
+		i := 0
+		for i < len(l.root.Dimensions) && CanonicalName(l.root.Dimensions[i].Name) != CanonicalName(d.Name) {
+			i++
+		}
+		if i == len(l.root.Dimensions) {
+			l.root.Dimensions = append(l.root.Dimensions, d)
+		} else if !sameElements(d, l.root.Dimensions[i]) {
+			return fmt.Errorf("%s: dimension %s differs from the one already loaded", p, d.Name)
+		}
+	}
+	for _, m := range f.Macros {
+		i := 0
+		for i < len(l.root.Macros) && CanonicalName(l.root.Macros[i].Name) != CanonicalName(m.Name) {
+			i++
+		}
+		if i == len(l.root.Macros) {
+			l.root.Macros = append(l.root.Macros, m)
+			continue
+		}
+		// names only need to match canonically.
+		same := *m
+		same.Name = l.root.Macros[i].Name
+		if !sameXML(&same, l.root.Macros[i]) {
+			return fmt.Errorf("%s: macro %s differs from the one already loaded", p, m.Name)
+		}
+	}
+	return nil
+}
+
+// nonNegative returns the file-wide default for stocks and flows.
+func nonNegative(b *Behavior) bool {
+	return b != nil && b.NonNegative
+}
+
+// sameElements reports whether a and b have the same elements.
+func sameElements(a, b *Dimension) bool {
+	x, errx := a.ElementNames()
+	y, erry := b.ElementNames()
+	if errx != nil || erry != nil || len(x) != len(y) {
+		return false
+	}
+	for i := range x {
+		if x[i] != y[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// sameXML reports whether a and b are written out the same.
+func sameXML(a, b interface{}) bool {
+	x, errx := xml.Marshal(a)
+	y, erry := xml.Marshal(b)
+	return errx == nil && erry == nil && bytes.Equal(x, y)
+}
+
+// model returns the model named name within f, or nil.
+func (l *loader) model(f *File, name string) *Model {
+	for _, m := range f.Models {
+		if CanonicalName(l.names[m]) == CanonicalName(name) {
+			return m
+		}
+	}
+	return nil
+}
+
+// rootModel returns the first model in f without a name, or the first
+// model if all of them are named.
+func rootModel(f *File) *Model {
+	for _, m := range f.Models {
+		if m.Name == "" {
+			return m
+		}
+	}
+	if len(f.Models) > 0 {
+		return f.Models[0]
+	}
+	return nil
+}
@@ -0,0 +1,181 @@
+// Copyright 2013 Bobby Powers. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package xmile_test
+
+import (
+	"strings"
+	"testing"
+	"testing/fstest"
+
+	"github.com/bpowers/go-xmile/xmile"
+)
+
+// xmileFile returns a XMILE document containing the given models.
+func xmileFile(models string) *fstest.MapFile {
+	return &fstest.MapFile{Data: []byte(`<?xml version="1.0" encoding="utf-8" ?>
+<xmile xmlns="http://www.systemdynamics.org/XMILE" version="1.0" level="3">
+	<sim_specs><start>0</start><stop>2</stop><dt>1</dt></sim_specs>
+` + models + `
+</xmile>`)}
+}
+
+// findModule returns the module named name in m.
+func findModule(t *testing.T, m *xmile.Model, name string) *xmile.Variable {
+	for _, v := range m.Variables {
+		if v.XMLName.Local == "module" && v.Name == name {
+			return v
+		}
+	}
+	t.Fatalf("model '%s' has no module '%s'", m.Name, name)
+	return nil
+}
+
+func TestLoad(t *testing.T) {
+	fsys := fstest.MapFS{
+		"models/root.xmile": xmileFile(`
+	<model>
+		<variables>
+			<aux name="rate"><eqn>.5</eqn></aux>
+			<module name="growth" resource="lib/growth.xmile">
+				<connect to="growth.rate" from="rate"/>
+			</module>
+			<module name="constant" resource="lib/growth.xmile#Other Model"/>
+			<aux name="pop"><eqn>growth.stock</eqn></aux>
+		</variables>
+	</model>`),
+		"models/lib/growth.xmile": xmileFile(`
+	<model>
+		<variables>
+			<stock name="stock">
+				<eqn>10</eqn>
+				<inflow>change</inflow>
+			</stock>
+			<flow name="change"><eqn>stock * rate</eqn></flow>
+			<aux name="rate"><eqn>.1</eqn></aux>
+			<module name="other_model"/>
+		</variables>
+	</model>
+	<model name="other_model">
+		<variables>
+			<aux name="value"><eqn>42</eqn></aux>
+		</variables>
+	</model>`),
+	}
+	f, err := xmile.Load(fsys, "models/root.xmile")
+	if err != nil {
+		t.Fatalf("Load: %s", err)
+	}
+	if len(f.Models) != 3 {
+		t.Fatalf("expected 3 models, not %d", len(f.Models))
+	}
+	for i, name := range []string{"", "models/lib/growth.xmile", "models/lib/growth.xmile#other_model"} {
+		if f.Models[i].Name != name {
+			t.Errorf("expected model %d to be named '%s', not '%s'", i, name, f.Models[i].Name)
+		}
+	}
+	cases := []struct {
+		m      *xmile.Model
+		module string
+		model  string
+	}{
+		{f.Models[0], "growth", "models/lib/growth.xmile"},
+		{f.Models[0], "constant", "models/lib/growth.xmile#other_model"},
+		{f.Models[1], "other_model", "models/lib/growth.xmile#other_model"},
+	}
+	for _, c := range cases {
+		v := findModule(t, c.m, c.module)
+		if v.Model != c.model || v.Resource != "" {
+			t.Errorf("%s: expected model '%s' and no resource, got '%s' and '%s'",
+				c.module, c.model, v.Model, v.Resource)
+		}
+	}
+	if conns := findModule(t, f.Models[0], "growth").Params; len(conns) != 1 || conns[0].To != "growth.rate" {
+		t.Errorf("expected growth's connection to be kept, got %v", conns)
+	}
+}
+
+func TestLoadDefinitions(t *testing.T) {
+	fsys := fstest.MapFS{
+		"root.xmile": xmileFile(`
+	<dimensions><dim name="Region" size="2"/></dimensions>
+	<model>
+		<variables>
+			<module name="sub" resource="sub.xmile"/>
+		</variables>
+	</model>`),
+		"sub.xmile": xmileFile(`
+	<dimensions>
+		<dim name="region" size="2"/>
+		<dim name="Age"><elem name="young"/><elem name="old"/></dim>
+	</dimensions>
+	<model>
+		<variables>
+			<aux name="pop">
+				<eqn>DOUBLE(1)</eqn>
+				<dimensions><dim name="Age"/></dimensions>
+			</aux>
+		</variables>
+	</model>
+	<macro name="DOUBLE">
+		<parm>x</parm>
+		<eqn>2 * x</eqn>
+	</macro>`),
+	}
+	f, err := xmile.Load(fsys, "root.xmile")
+	if err != nil {
+		t.Fatalf("Load: %s", err)
+	}
+	if len(f.Dimensions) != 2 || f.Dimensions[0].Name != "Region" || f.Dimensions[1].Name != "Age" {
+		t.Errorf("expected dimensions Region and Age, got %v", f.Dimensions)
+	}
+	if len(f.Macros) != 1 || f.Macros[0].Name != "DOUBLE" {
+		t.Errorf("expected the macro DOUBLE, got %v", f.Macros)
+	}
+}
+
+func TestLoadErrors(t *testing.T) {
+	module := func(resource string) *fstest.MapFile {
+		return xmileFile(`<model><variables><module name="m" resource="` + resource + `"/></variables></model>`)
+	}
+	fsys := fstest.MapFS{
+		"a.xmile":        module("b.xmile"),
+		"b.xmile":        module("sub/c.xmile"),
+		"sub/c.xmile":    module("../a.xmile"),
+		"self.xmile":     module("self.xmile"),
+		"missing.xmile":  module("nowhere.xmile"),
+		"outside.xmile":  module("../x.xmile"),
+		"fragment.xmile": module("leaf.xmile#nothing"),
+		"bad.xmile":      {Data: []byte("<xmile")},
+		"leaf.xmile":     xmileFile(`<model><variables><aux name="x"><eqn>1</eqn></aux></variables></model>`),
+		"dim.xmile": xmileFile(`<dimensions><dim name="d" size="2"/></dimensions>
+			<model><variables><module name="m" resource="dim_sub.xmile"/></variables></model>`),
+		"dim_sub.xmile": xmileFile(`<dimensions><dim name="D" size="3"/></dimensions><model/>`),
+		"macro.xmile": xmileFile(`<model><variables><module name="m" resource="macro_sub.xmile"/></variables></model>
+			<macro name="f"><parm>x</parm><eqn>x</eqn></macro>`),
+		"macro_sub.xmile":    xmileFile(`<model/><macro name="F"><parm>x</parm><eqn>2 * x</eqn></macro>`),
+		"behavior.xmile":     module("behavior_sub.xmile"),
+		"behavior_sub.xmile": xmileFile(`<behavior non_negative="true"/><model/>`),
+	}
+	cases := []struct {
+		name string
+		err  string
+	}{
+		{"a.xmile", "module resources form a cycle: a.xmile -> b.xmile -> sub/c.xmile -> a.xmile"},
+		{"self.xmile", "module resources form a cycle: self.xmile -> self.xmile"},
+		{"missing.xmile", "nowhere.xmile"},
+		{"outside.xmile", "bad resource '../x.xmile'"},
+		{"fragment.xmile", "no model in 'leaf.xmile#nothing'"},
+		{"bad.xmile", "bad.xmile: xml.Unmarshal"},
+		{"dim.xmile", "dim_sub.xmile: dimension D differs from the one already loaded"},
+		{"macro.xmile", "macro_sub.xmile: macro F differs from the one already loaded"},
+		{"behavior.xmile", "behavior_sub.xmile: behavior differs from 'behavior.xmile'"},
+	}
+	for _, c := range cases {
+		_, err := xmile.Load(fsys, c.name)
+		if err == nil || !strings.Contains(err.Error(), c.err) {
+			t.Errorf("%s: expected error containing '%s', got %v", c.name, c.err, err)
+		}
+	}
+}
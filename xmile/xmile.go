@@ -8,6 +8,9 @@ import (
 	"crypto/rand"
 	"encoding/xml"
 	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
 )
 
 // An XML node
@@ -20,6 +23,7 @@ func (*Behavior) node()  {}
 func (*Model) node()     {}
 func (*Variable) node()  {}
 func (*Dimension) node() {}
+func (*Macro) node()     {}
 
 // the standard XML declaration, declared as a constant for easy
 // reuse.
@@ -32,15 +36,17 @@ type File struct {
 	Level      int          `xml:"level,attr"`
 	Header     Header       `xml:"header"`
 	SimSpec    SimSpec      `xml:"sim_specs"`
-	Dimensions []*Dimension `xml:"dimensions>dim,omitempty"`
+	Dimensions Dimensions   `xml:"dimensions"`
 	ModelUnits *ModelUnits  `xml:"model_units"`
 	Behavior   *Behavior    `xml:"behavior"`
 	Models     []*Model     `xml:"model"`
+	Macros     []*Macro     `xml:"macro,omitempty"`
 }
 
+// Behavior contains file-wide defaults for variables.
 type Behavior struct {
 	XMLName xml.Name
-	NonNegative bool `xml:"non_negative,attr"`
+	NonNegative bool `xml:"non_negative,attr"` // for stocks and flows
 }
 
 type ModelUnits struct {
@@ -84,10 +90,85 @@ type Header struct {
 	Product Product `xml:"product"`
 }
 
+// Dimension is a named list of subscripts that variables can be
+// arrayed over.  A file's dimensions either have named elements, or a
+// Size, in which case their elements are numbered from 1.  The
+// dimensions of an arrayed variable only give their Name, referring
+// to one of the file's dimensions.
 type Dimension struct {
-	XMLName xml.Name `xml:"dim"`
-	Name    string   `xml:"name,attr"`
-	Size    string   `xml:"size,attr"`
+	XMLName  xml.Name `xml:"dim"`
+	Name     string   `xml:"name,attr"`
+	Size     string   `xml:"size,attr,omitempty"`
+	Elements []*Elem  `xml:"elem,omitempty"`
+}
+
+// Dimensions are the children of a <dimensions> tag.  Unlike a
+// "dimensions>dim" field, which encoding/xml writes as an empty
+// <dimensions> tag even when there are none, Dimensions writes
+// nothing if it is empty.
+type Dimensions []*Dimension
+
+// UnmarshalXML decodes every child of start as a Dimension.
+func (ds *Dimensions) UnmarshalXML(d *xml.Decoder, start xml.StartElement) error {
+	for {
+		tok, err := d.Token()
+		if err != nil {
+			return err
+		}
+		switch t := tok.(type) {
+		case xml.StartElement:
+			dim := new(Dimension)
+			if err := d.DecodeElement(dim, &t); err != nil {
+				return err
+			}
+			dim.XMLName.Space = ""
+			*ds = append(*ds, dim)
+		case xml.EndElement:
+			return nil
+		}
+	}
+}
+
+// MarshalXML encodes the dimensions inside a single start tag.
+func (ds Dimensions) MarshalXML(e *xml.Encoder, start xml.StartElement) error {
+	if len(ds) == 0 {
+		return nil
+	}
+	if err := e.EncodeToken(start); err != nil {
+		return err
+	}
+	for _, d := range ds {
+		if err := e.Encode(d); err != nil {
+			return err
+		}
+	}
+	return e.EncodeToken(start.End())
+}
+
+// Elem is a named element of a Dimension.
+type Elem struct {
+	Name string `xml:"name,attr"`
+}
+
+// ElementNames returns the names of d's elements, which are numbers
+// if d only has a Size.
+func (d *Dimension) ElementNames() ([]string, error) {
+	if len(d.Elements) > 0 {
+		names := make([]string, len(d.Elements))
+		for i, e := range d.Elements {
+			names[i] = e.Name
+		}
+		return names, nil
+	}
+	n, err := strconv.Atoi(strings.TrimSpace(d.Size))
+	if err != nil || n < 1 {
+		return nil, fmt.Errorf("dimension %s: bad size '%s'", d.Name, d.Size)
+	}
+	names := make([]string, n)
+	for i := range names {
+		names[i] = strconv.Itoa(i + 1)
+	}
+	return names, nil
 }
 
 // Smile contains information on the features used in this model.
@@ -127,10 +208,72 @@ type SimSpec struct {
 // of a system dynamics model, as well as the visual representations
 // of that model.
 type Model struct {
-	XMLName   xml.Name    `xml:"model"`
-	Name      string      `xml:"name,attr,omitempty"`
-	Variables []*Variable `xml:"variables>variable"`
-	Views     *[]*View    `xml:"views>view"`
+	XMLName   xml.Name  `xml:"model"`
+	Name      string    `xml:"name,attr,omitempty"`
+	Variables Variables `xml:"variables"`
+	Views     *[]*View  `xml:"views>view"`
+}
+
+// Macro is a user-defined function.  A call to a macro is replaced by
+// its Eqn, in which the macro's parameters stand for the call's
+// arguments.  The macro's own Variables, such as stocks that give it
+// state, are private to each call, and can be referred to by Eqn.
+type Macro struct {
+	XMLName   xml.Name  `xml:"macro"`
+	Name      string    `xml:"name,attr"`
+	Doc       string    `xml:"doc,omitempty"`
+	Parms     []*Parm   `xml:"parm"`
+	Eqn       string    `xml:"eqn"`
+	Variables Variables `xml:"variables"`
+}
+
+// Parm is a parameter of a Macro.  Parameters with a Default, an
+// equation that may refer to earlier parameters, are optional.
+type Parm struct {
+	Name    string `xml:",chardata"`
+	Default string `xml:"default,attr,omitempty"`
+}
+
+// Variables are the variables of a model, which are the children of
+// its <variables> tag.  Each variable's tag gives its type.
+type Variables []*Variable
+
+// UnmarshalXML decodes every child of start as a Variable, whatever
+// its tag.
+func (vs *Variables) UnmarshalXML(d *xml.Decoder, start xml.StartElement) error {
+	for {
+		tok, err := d.Token()
+		if err != nil {
+			return err
+		}
+		switch t := tok.(type) {
+		case xml.StartElement:
+			v := new(Variable)
+			if err := d.DecodeElement(v, &t); err != nil {
+				return err
+			}
+			v.XMLName.Space = ""
+			*vs = append(*vs, v)
+		case xml.EndElement:
+			return nil
+		}
+	}
+}
+
+// MarshalXML encodes the variables inside a single start tag.
+func (vs Variables) MarshalXML(e *xml.Encoder, start xml.StartElement) error {
+	if len(vs) == 0 {
+		return nil
+	}
+	if err := e.EncodeToken(start); err != nil {
+		return err
+	}
+	for _, v := range vs {
+		if err := e.Encode(v); err != nil {
+			return err
+		}
+	}
+	return e.EncodeToken(start.End())
 }
 
 // View is a collection of objects representing the visual structure
@@ -177,9 +320,90 @@ type Variable struct {
 	NonNeg     *Exister   `xml:"non_negative"`      // stock,(uni-)flow
 	Inflows    []string   `xml:"inflow,omitempty"`  // empty for non-stocks
 	Outflows   []string   `xml:"outflow,omitempty"` // empty for non-stocks
+	Conveyor   *Conveyor  `xml:"conveyor"`          // stock
+	Queue      *Exister   `xml:"queue"`             // stock
+	Oven       *Oven      `xml:"oven"`              // stock
+	Overflow   *Exister   `xml:"overflow"`          // flow out of a queue
+	Leak       *Exister   `xml:"leak"`              // flow out of a conveyor
+	LeakInts   *Exister   `xml:"leak_integers"`     // flow out of a conveyor
 	Units      string     `xml:"units,omitempty"`
 	GF         *GF        `xml:"gf"` // nil if one doesn't exist
 	Params     []*Connect `xml:",any,omitempty"`
+
+	// Dimensions, if present, make the variable an array with an
+	// element for each combination of their elements.  Eqn then
+	// applies to every element, except those with an Element of
+	// their own.
+	Dimensions Dimensions `xml:"dimensions"`
+	Elements   []*Element `xml:"element,omitempty"`
+
+	// Model is the name of the model a module is an instance of,
+	// if it isn't the module's Name.  Resource, if set, is the
+	// path of the file containing that model, in which case the
+	// model is the file's root model unless the path ends with
+	// "#" and a model name.  Params holds the module's
+	// connections, whose To and From are qualified with the
+	// module's name when they refer to the module's variables, as
+	// in "sub.input".
+	Model    string `xml:"model,attr,omitempty"`
+	Resource string `xml:"resource,attr,omitempty"`
+}
+
+// Element is the equation of a single element of an arrayed
+// variable.  Subscript lists the element's name in each of the
+// variable's dimensions, separated by commas.
+type Element struct {
+	Subscript string `xml:"subscript,attr"`
+	Eqn       string `xml:"eqn"`
+}
+
+// Conveyor contains the options of a conveyor stock, through which
+// material moves in a fixed transit time.  A conveyor's first outflow
+// without a leak tag receives the material reaching the end of the
+// conveyor, and its other outflows are leakage flows, whose
+// equations give the fraction of material that leaks.  Len,
+// Capacity, InLimit, Sample and Arrest are equations.
+type Conveyor struct {
+	Len      string `xml:"len"` // transit time
+	Capacity string `xml:"capacity,omitempty"`
+	InLimit  string `xml:"in_limit,omitempty"` // maximum inflow rate
+	// Sample, if given, only lets material in when it is non-zero.
+	Sample string `xml:"sample,omitempty"`
+	// Arrest stops the conveyor while it is non-zero.
+	Arrest string `xml:"arrest,omitempty"`
+	// LeakStart and LeakEnd are the fractions of the conveyor's
+	// length between which material leaks.  A LeakEnd of 0 means
+	// the end of the conveyor.
+	LeakStart       float64  `xml:"leak_start,attr,omitempty"`
+	LeakEnd         float64  `xml:"leak_end,attr,omitempty"`
+	ExponentialLeak *Exister `xml:"exponential_leak"`
+	Discrete        *Exister `xml:"discrete"`
+	BatchIntegrity  *Exister `xml:"batch_integrity"`
+	OneAtATime      *Exister `xml:"one_at_a_time"`
+}
+
+// Oven contains the options of an oven stock, which fills with
+// material for up to FillTime or until it reaches Capacity, holds it
+// for CookTime, and then releases all of it at once through its
+// outflow.  Capacity, FillTime and CookTime are equations, and an
+// empty Capacity means there is no limit.  With Interleaving the
+// oven's inflows share the room left in it in proportion to their
+// rates, rather than being served in the order they are listed.
+type Oven struct {
+	Capacity     string   `xml:"capacity,omitempty"`
+	FillTime     string   `xml:"fill_time"`
+	CookTime     string   `xml:"cook_time"`
+	Interleaving *Exister `xml:"interleaving"`
+}
+
+// NonNegative reports whether v, a stock or flow, must not go
+// negative.  A non_negative tag containing "false" turns off the
+// file-wide default in b, which may be nil.
+func (v *Variable) NonNegative(b *Behavior) bool {
+	if v.NonNeg != nil {
+		return !strings.EqualFold(strings.TrimSpace(string(*v.NonNeg)), "false")
+	}
+	return b != nil && b.NonNegative
 }
 
 type Connect struct {
@@ -189,9 +413,11 @@ type Connect struct {
 }
 
 // GF contains the definition of a graphical function associated with
-// a variable.
+// a variable.  Type takes precedence over Discrete, which is only
+// consulted when Type is empty.  See Table for evaluating a GF.
 type GF struct {
 	XMLName  xml.Name `xml:"gf"`
+	Type     GFType   `xml:"type,attr,omitempty"`
 	Discrete bool     `xml:"discrete,attr"`
 	XPoints  string   `xml:"xpts,omitempty"`
 	YPoints  string   `xml:"ypts"`
@@ -329,6 +555,28 @@ func UUIDv4() (string, error) {
 	return fmt.Sprintf("%x-%x-%x-%x-%x", b[0:4], b[4:6], b[6:8], b[8:10], b[10:]), nil
 }
 
+var separatorRegexp = regexp.MustCompile(`[ \t\r\n_]+`)
+
+// CanonicalName converts a name, as found either in a name attribute
+// or in an equation, into a form in which names that refer to the
+// same thing are equal: lower case, with runs of whitespace and
+// underscores replaced by a single underscore.  isee products write
+// newlines in names as a literal `\n`, which we treat as any other
+// whitespace.  The subscripts of an array element, as in
+// "pop[North, Young]", are canonicalized separately.
+func CanonicalName(name string) string {
+	if i := strings.IndexByte(name, '['); i > 0 && strings.HasSuffix(name, "]") {
+		subs := strings.Split(name[i+1:len(name)-1], ",")
+		for j, sub := range subs {
+			subs[j] = CanonicalName(strings.TrimSpace(sub))
+		}
+		return CanonicalName(name[:i]) + "[" + strings.Join(subs, ",") + "]"
+	}
+	name = strings.Replace(name, `\n`, "_", -1)
+	name = separatorRegexp.ReplaceAllString(name, "_")
+	return strings.ToLower(name)
+}
+
 // NewFile returns a new File object of the given XMILE compliance
 // level and name, along with a new UUID.
 func NewFile(level int, name string) *File {
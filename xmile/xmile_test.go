@@ -11,6 +11,7 @@ import (
 	"fmt"
 	compat "github.com/bpowers/go-xmile/compat"
 	"github.com/bpowers/go-xmile/smile"
+	"github.com/bpowers/go-xmile/xmile"
 	"io/ioutil"
 	"log"
 	"os"
@@ -157,11 +158,109 @@ func TestRead(t *testing.T) {
 		t.Fatalf("xml.MarshalIndent: %s", err)
 	}
 
-	os.Stderr.Write([]byte(compat.XMLDeclaration + "\n"))
+	os.Stderr.Write([]byte(xmile.XMLDeclaration + "\n"))
 	os.Stderr.Write(output)
 	os.Stderr.Write([]byte("\n"))
 }
 
+func TestVariables(t *testing.T) {
+	const model = `<model xmlns="http://www.systemdynamics.org/XMILE">
+	<variables>
+		<stock name="pop"><eqn>100</eqn><inflow>births</inflow></stock>
+		<flow name="births"><eqn>pop * rate</eqn></flow>
+		<aux name="rate"><eqn>.1</eqn></aux>
+		<module name="sub"/>
+	</variables>
+</model>`
+	m := new(xmile.Model)
+	if err := xml.Unmarshal([]byte(model), m); err != nil {
+		t.Fatalf("xml.Unmarshal: %s", err)
+	}
+	expected := []xml.Name{{Local: "stock"}, {Local: "flow"}, {Local: "aux"}, {Local: "module"}}
+	if len(m.Variables) != len(expected) {
+		t.Fatalf("expected %d variables, got %d", len(expected), len(m.Variables))
+	}
+	for i, v := range m.Variables {
+		if v.XMLName != expected[i] {
+			t.Errorf("variable %d: expected tag %v, got %v", i, expected[i], v.XMLName)
+		}
+	}
+	if v := m.Variables[0]; v.Name != "pop" || v.Eqn != "100" || len(v.Inflows) != 1 {
+		t.Errorf("pop decoded wrong: %+v", v)
+	}
+
+	output, err := xml.Marshal(m)
+	if err != nil {
+		t.Fatalf("xml.Marshal: %s", err)
+	}
+	if n := strings.Count(string(output), "<variables>"); n != 1 {
+		t.Errorf("expected a single <variables> tag, got %d in %s", n, output)
+	}
+	again := new(xmile.Model)
+	if err := xml.Unmarshal(output, again); err != nil {
+		t.Fatalf("xml.Unmarshal: %s", err)
+	}
+	if len(again.Variables) != len(expected) {
+		t.Fatalf("expected %d variables after a round trip, got %d", len(expected), len(again.Variables))
+	}
+	for i, v := range again.Variables {
+		if v.XMLName != expected[i] || v.Name != m.Variables[i].Name {
+			t.Errorf("variable %d changed in a round trip: %+v", i, v)
+		}
+	}
+
+	output, err = xml.Marshal(&xmile.Model{})
+	if err != nil {
+		t.Fatalf("xml.Marshal: %s", err)
+	}
+	if strings.Contains(string(output), "variables") {
+		t.Errorf("expected no <variables> tag for an empty model, got %s", output)
+	}
+}
+
+func TestDimensions(t *testing.T) {
+	output, err := xml.Marshal(&xmile.Variable{XMLName: xml.Name{Local: "aux"}, Name: "a", Eqn: "1"})
+	if err != nil {
+		t.Fatalf("xml.Marshal: %s", err)
+	}
+	if expected := `<aux name="a"><eqn>1</eqn></aux>`; string(output) != expected {
+		t.Errorf("expected a scalar variable to marshal as %s, got %s", expected, output)
+	}
+
+	const arrayed = `<aux name="pop"><eqn>1</eqn><dimensions><dim name="Region"></dim><dim name="Age"></dim></dimensions></aux>`
+	v := new(xmile.Variable)
+	if err := xml.Unmarshal([]byte(arrayed), v); err != nil {
+		t.Fatalf("xml.Unmarshal: %s", err)
+	}
+	if len(v.Dimensions) != 2 || v.Dimensions[0].Name != "Region" || v.Dimensions[1].Name != "Age" {
+		t.Fatalf("expected dimensions Region and Age, got %v", v.Dimensions)
+	}
+	output, err = xml.Marshal(v)
+	if err != nil {
+		t.Fatalf("xml.Marshal: %s", err)
+	}
+	if string(output) != arrayed {
+		t.Errorf("expected %s after a round trip, got %s", arrayed, output)
+	}
+}
+
+func TestCanonicalName(t *testing.T) {
+	cases := []struct {
+		in, out string
+	}{
+		{"Birth Rate", "birth_rate"},
+		{"birth__rate", "birth_rate"},
+		{"birth \t\n rate", "birth_rate"},
+		{`birth\nrate`, "birth_rate"},
+		{"Pop[North, Young Adults]", "pop[north,young_adults]"},
+	}
+	for _, c := range cases {
+		if out := xmile.CanonicalName(c.in); out != c.out {
+			t.Errorf("CanonicalName(%q): expected %q, got %q", c.in, c.out, out)
+		}
+	}
+}
+
 /*
 func TestDot(t *testing.T) {
 	contents, err := ioutil.ReadFile("../models/pred_prey.stmx")